@@ -0,0 +1,62 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// conversionDataAnnotation holds the v1alpha2 fields v1alpha1 has no place
+// for, so that an object read and written back through v1alpha1 keeps them.
+const conversionDataAnnotation = "aks.azure.com/v1alpha2-conversion-data"
+
+// stashConversionData records data in the annotations of obj.
+func stashConversionData(obj metav1.Object, data any) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("marshaling conversion data: %w", err)
+	}
+	annotations := make(map[string]string, len(obj.GetAnnotations())+1)
+	maps.Copy(annotations, obj.GetAnnotations())
+	annotations[conversionDataAnnotation] = string(raw)
+	obj.SetAnnotations(annotations)
+	return nil
+}
+
+// restoreConversionData reads the data recorded by stashConversionData into
+// data and removes it from the annotations of obj. It reports whether obj had
+// any data recorded.
+func restoreConversionData(obj metav1.Object, data any) (bool, error) {
+	raw, ok := obj.GetAnnotations()[conversionDataAnnotation]
+	if !ok {
+		return false, nil
+	}
+	annotations := maps.Clone(obj.GetAnnotations())
+	delete(annotations, conversionDataAnnotation)
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	obj.SetAnnotations(annotations)
+	if err := json.Unmarshal([]byte(raw), data); err != nil {
+		return false, fmt.Errorf("unmarshaling conversion data: %w", err)
+	}
+	return true, nil
+}
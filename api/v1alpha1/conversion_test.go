@@ -0,0 +1,133 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+)
+
+func TestPeerConversionRoundTrip(t *testing.T) {
+	handshake := metav1.NewTime(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	hub := &v1alpha2.Peer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node-1",
+			Namespace:   "kube-system",
+			Annotations: map[string]string{"example.com/note": "kept"},
+		},
+		Spec: v1alpha2.PeerSpec{
+			ListenPort: 51820,
+			PublicKey:  "pub",
+			Endpoint:   "10.224.0.4",
+			PodIPs:     []string{"10.244.1.0/24"},
+			MeshIP:     "100.255.224.10",
+			AllowedIPs: []string{"192.168.0.0/24"},
+		},
+		Status: v1alpha2.PeerStatus{
+			MeshIP:        "100.255.224.10",
+			MeshSubnet:    "100.255.224.0/19",
+			MeshIPs:       []string{"100.255.224.10", "fdaa:5e55:100:ffff::a"},
+			MeshSubnets:   []string{"100.255.224.0/19", "fdaa:5e55:100:ffff::/112"},
+			ActiveGateway: "node-2",
+			Gateways:      []v1alpha2.GatewayTunnelStatus{{Name: "node-2", LastHandshakeTime: &handshake, ReceiveBytes: 1}},
+		},
+	}
+
+	spoke := &Peer{}
+	if err := spoke.ConvertFrom(hub.DeepCopy()); err != nil {
+		t.Fatalf("ConvertFrom: %v", err)
+	}
+	if _, ok := spoke.Annotations[conversionDataAnnotation]; !ok {
+		t.Errorf("v1alpha1 Peer has no %s annotation", conversionDataAnnotation)
+	}
+	got := &v1alpha2.Peer{}
+	if err := spoke.ConvertTo(got); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	if !equality.Semantic.DeepEqual(got, hub) {
+		t.Errorf("round trip through v1alpha1 changed the Peer:\ngot  %+v\nwant %+v", got, hub)
+	}
+}
+
+func TestGatewayConversionRoundTrip(t *testing.T) {
+	hub := &v1alpha2.Gateway{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Namespace: "kube-system"},
+		Spec: v1alpha2.GatewaySpec{
+			ListenPort: 51820,
+			PublicKey:  "pub",
+			Endpoint:   "10.224.0.4",
+			MeshIP:     "100.255.224.1",
+		},
+		Status: v1alpha2.GatewayStatus{
+			MeshIP:          "100.255.224.1",
+			MeshSubnet:      "100.255.224.0/19",
+			MeshIPs:         []string{"100.255.224.1"},
+			MeshSubnets:     []string{"100.255.224.0/19"},
+			ListenPort:      51820,
+			ConfiguredPeers: 2,
+			ActivePeers:     1,
+			NodeName:        "node-1",
+			PodName:         "gateway-abc",
+			FailedPeers:     []v1alpha2.PeerFailure{{Name: "node-3", Reason: "invalid key"}},
+		},
+	}
+
+	spoke := &Gateway{}
+	if err := spoke.ConvertFrom(hub.DeepCopy()); err != nil {
+		t.Fatalf("ConvertFrom: %v", err)
+	}
+	got := &v1alpha2.Gateway{}
+	if err := spoke.ConvertTo(got); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	if !equality.Semantic.DeepEqual(got, hub) {
+		t.Errorf("round trip through v1alpha1 changed the Gateway:\ngot  %+v\nwant %+v", got, hub)
+	}
+}
+
+// TestConvertToWithoutConversionData covers objects written through v1alpha1
+// and objects stored as v1alpha1 before v1alpha2 existed, which the storage
+// version migration rewrites as v1alpha2.
+func TestConvertToWithoutConversionData(t *testing.T) {
+	spoke := &Gateway{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Namespace: "kube-system"},
+		Spec:       GatewaySpec{PrivateKey: "secret", ListenPort: 51820, PublicKey: "pub", Endpoint: "10.224.0.4"},
+		Status:     GatewayStatus{ConfiguredPeers: 2, ActivePeers: 1},
+	}
+	hub := &v1alpha2.Gateway{}
+	if err := spoke.ConvertTo(hub); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	if hub.Annotations != nil {
+		t.Errorf("annotations = %v, want none", hub.Annotations)
+	}
+
+	got := &Gateway{}
+	if err := got.ConvertFrom(hub); err != nil {
+		t.Fatalf("ConvertFrom: %v", err)
+	}
+	want := spoke.DeepCopy()
+	want.Spec.PrivateKey = ""
+	if !equality.Semantic.DeepEqual(got, want) {
+		t.Errorf("round trip through v1alpha2 changed the Gateway:\ngot  %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"slices"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+)
+
+// gatewayConversionData holds the v1alpha2 Gateway fields missing from
+// v1alpha1.
+// +kubebuilder:object:generate=false
+type gatewayConversionData struct {
+	SpecMeshIP  string   `json:"specMeshIP,omitempty"`
+	MeshIP      string   `json:"meshIP,omitempty"`
+	MeshSubnet  string   `json:"meshSubnet,omitempty"`
+	MeshIPs     []string `json:"meshIPs,omitempty"`
+	MeshSubnets []string `json:"meshSubnets,omitempty"`
+	NodeName    string   `json:"nodeName,omitempty"`
+	PodName     string   `json:"podName,omitempty"`
+}
+
+// ConvertTo converts this Gateway to the Hub version (v1alpha2). The private
+// key is dropped, so it is never written to storage. Fields added in v1alpha2,
+// such as the mesh IP, are not served by v1alpha1; they are restored from the
+// annotation ConvertFrom recorded them in.
+func (src *Gateway) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1alpha2.Gateway)
+	dst.ObjectMeta = src.ObjectMeta
+
+	dst.Spec = v1alpha2.GatewaySpec{
+		ListenPort:    src.Spec.ListenPort,
+		PublicKey:     src.Spec.PublicKey,
+		Endpoint:      src.Spec.Endpoint,
+		NextPublicKey: src.Spec.NextPublicKey,
+	}
+
+	dst.Status = v1alpha2.GatewayStatus{
+		PublicKeyFingerprint: src.Status.PublicKeyFingerprint,
+		LastKeyRotationTime:  src.Status.LastKeyRotationTime,
+		ListenPort:           src.Status.ListenPort,
+		ConfiguredPeers:      src.Status.ConfiguredPeers,
+		ActivePeers:          src.Status.ActivePeers,
+		Conditions:           src.Status.Conditions,
+	}
+	for _, f := range src.Status.FailedPeers {
+		dst.Status.FailedPeers = append(dst.Status.FailedPeers, v1alpha2.PeerFailure(f))
+	}
+
+	var data gatewayConversionData
+	if _, err := restoreConversionData(dst, &data); err != nil {
+		return err
+	}
+	dst.Spec.MeshIP = data.SpecMeshIP
+	dst.Status.MeshIP = data.MeshIP
+	dst.Status.MeshSubnet = data.MeshSubnet
+	dst.Status.MeshIPs = data.MeshIPs
+	dst.Status.MeshSubnets = data.MeshSubnets
+	dst.Status.NodeName = data.NodeName
+	dst.Status.PodName = data.PodName
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v1alpha2) to this version. The
+// private key is always left empty. Fields missing from v1alpha1 are recorded
+// in an annotation.
+func (dst *Gateway) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1alpha2.Gateway)
+	dst.ObjectMeta = src.ObjectMeta
+
+	dst.Spec = GatewaySpec{
+		ListenPort:    src.Spec.ListenPort,
+		PublicKey:     src.Spec.PublicKey,
+		Endpoint:      src.Spec.Endpoint,
+		NextPublicKey: src.Spec.NextPublicKey,
+	}
+
+	dst.Status = GatewayStatus{
+		PublicKeyFingerprint: src.Status.PublicKeyFingerprint,
+		LastKeyRotationTime:  src.Status.LastKeyRotationTime,
+		ListenPort:           src.Status.ListenPort,
+		ConfiguredPeers:      src.Status.ConfiguredPeers,
+		ActivePeers:          src.Status.ActivePeers,
+		Conditions:           src.Status.Conditions,
+	}
+	for _, f := range src.Status.FailedPeers {
+		dst.Status.FailedPeers = append(dst.Status.FailedPeers, PeerFailure(f))
+	}
+
+	data := gatewayConversionData{
+		SpecMeshIP:  src.Spec.MeshIP,
+		MeshIP:      src.Status.MeshIP,
+		MeshSubnet:  src.Status.MeshSubnet,
+		MeshIPs:     slices.Clone(src.Status.MeshIPs),
+		MeshSubnets: slices.Clone(src.Status.MeshSubnets),
+		NodeName:    src.Status.NodeName,
+		PodName:     src.Status.PodName,
+	}
+	if equality.Semantic.DeepEqual(data, gatewayConversionData{}) {
+		return nil
+	}
+	return stashConversionData(dst, data)
+}
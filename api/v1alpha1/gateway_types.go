@@ -28,21 +28,71 @@ type GatewaySpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	// Foo is an example field of Gateway. Edit gateway_types.go to remove/update
-	PrivateKey string `json:"privateKey"`
+	// Deprecated: PrivateKey is ignored and never stored. Private keys
+	// stay on the node, only the public key is published.
+	PrivateKey string `json:"privateKey,omitempty"`
 	ListenPort int    `json:"listenPort"`
 	PublicKey  string `json:"publicKey"`
 	Endpoint   string `json:"endpoint"`
+	// NextPublicKey is the key the gateway switches to at its next key rotation.
+	// Counterparts add it ahead of time so the switch does not drop traffic.
+	NextPublicKey string `json:"nextPublicKey,omitempty"`
 }
 
 // GatewayStatus defines the observed state of Gateway
 type GatewayStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// PublicKeyFingerprint identifies the public key currently in use.
+	PublicKeyFingerprint string `json:"publicKeyFingerprint,omitempty"`
+	// LastKeyRotationTime is when the current key was put into use.
+	LastKeyRotationTime *metav1.Time `json:"lastKeyRotationTime,omitempty"`
+	// ListenPort is the UDP port the gateway device listens on.
+	ListenPort int `json:"listenPort,omitempty"`
+	// ConfiguredPeers is the number of Peers configured on the gateway device.
+	ConfiguredPeers int `json:"configuredPeers"`
+	// ActivePeers is the number of configured Peers that completed a
+	// handshake within the gateway's handshake timeout.
+	ActivePeers int `json:"activePeers"`
+	// FailedPeers lists the Peers the gateway could not configure.
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	FailedPeers []PeerFailure `json:"failedPeers,omitempty"`
+	// Conditions are the Ready and Degraded conditions of the gateway.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// Condition types reported in GatewayStatus.Conditions.
+const (
+	// GatewayReady is true when the gateway device is up and listening.
+	GatewayReady = "Ready"
+	// GatewayDegraded is true when some Peers could not be configured.
+	GatewayDegraded = "Degraded"
+)
+
+// PeerFailure is a Peer the gateway could not configure.
+type PeerFailure struct {
+	// Name of the Peer.
+	Name string `json:"name"`
+	// Reason the Peer could not be configured.
+	Reason string `json:"reason"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:deprecatedversion:warning="aks.azure.com/v1alpha1 Gateway is deprecated, use aks.azure.com/v1alpha2"
+// +kubebuilder:printcolumn:name="Endpoint",type=string,JSONPath=`.spec.endpoint`
+// +kubebuilder:printcolumn:name="Port",type=integer,JSONPath=`.status.listenPort`
+// +kubebuilder:printcolumn:name="Peers",type=integer,JSONPath=`.status.configuredPeers`
+// +kubebuilder:printcolumn:name="Active",type=integer,JSONPath=`.status.activePeers`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Degraded",type=string,JSONPath=`.status.conditions[?(@.type=="Degraded")].status`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Gateway is the Schema for the gateways API
 type Gateway struct {
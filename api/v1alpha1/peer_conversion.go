@@ -0,0 +1,113 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"slices"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+)
+
+// peerConversionData holds the v1alpha2 Peer fields missing from v1alpha1.
+// +kubebuilder:object:generate=false
+type peerConversionData struct {
+	MeshIPs       []string `json:"meshIPs,omitempty"`
+	MeshSubnets   []string `json:"meshSubnets,omitempty"`
+	ActiveGateway string   `json:"activeGateway,omitempty"`
+}
+
+// ConvertTo converts this Peer to the Hub version (v1alpha2). The private key
+// is dropped, so it is never written to storage. Fields missing from v1alpha1
+// are restored from the annotation ConvertFrom recorded them in.
+func (src *Peer) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1alpha2.Peer)
+	dst.ObjectMeta = src.ObjectMeta
+
+	dst.Spec = v1alpha2.PeerSpec{
+		ListenPort:    src.Spec.ListenPort,
+		PublicKey:     src.Spec.PublicKey,
+		Endpoint:      src.Spec.Endpoint,
+		PodIPs:        src.Spec.PodIPs,
+		MeshIP:        src.Spec.MeshIP,
+		AllowedIPs:    src.Spec.AllowedIPs,
+		NextPublicKey: src.Spec.NextPublicKey,
+	}
+
+	dst.Status = v1alpha2.PeerStatus{
+		MeshIP:               src.Status.MeshIP,
+		MeshSubnet:           src.Status.MeshSubnet,
+		PublicKeyFingerprint: src.Status.PublicKeyFingerprint,
+		LastKeyRotationTime:  src.Status.LastKeyRotationTime,
+		ObservedGeneration:   src.Status.ObservedGeneration,
+		Conditions:           src.Status.Conditions,
+	}
+	for _, gw := range src.Status.Gateways {
+		dst.Status.Gateways = append(dst.Status.Gateways, v1alpha2.GatewayTunnelStatus(gw))
+	}
+
+	var data peerConversionData
+	if _, err := restoreConversionData(dst, &data); err != nil {
+		return err
+	}
+	dst.Status.MeshIPs = data.MeshIPs
+	dst.Status.MeshSubnets = data.MeshSubnets
+	dst.Status.ActiveGateway = data.ActiveGateway
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v1alpha2) to this version. The
+// private key is always left empty. Fields missing from v1alpha1 are recorded
+// in an annotation.
+func (dst *Peer) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1alpha2.Peer)
+	dst.ObjectMeta = src.ObjectMeta
+
+	dst.Spec = PeerSpec{
+		ListenPort:    src.Spec.ListenPort,
+		PublicKey:     src.Spec.PublicKey,
+		Endpoint:      src.Spec.Endpoint,
+		PodIPs:        src.Spec.PodIPs,
+		MeshIP:        src.Spec.MeshIP,
+		AllowedIPs:    src.Spec.AllowedIPs,
+		NextPublicKey: src.Spec.NextPublicKey,
+	}
+
+	dst.Status = PeerStatus{
+		MeshIP:               src.Status.MeshIP,
+		MeshSubnet:           src.Status.MeshSubnet,
+		PublicKeyFingerprint: src.Status.PublicKeyFingerprint,
+		LastKeyRotationTime:  src.Status.LastKeyRotationTime,
+		ObservedGeneration:   src.Status.ObservedGeneration,
+		Conditions:           src.Status.Conditions,
+	}
+	for _, gw := range src.Status.Gateways {
+		dst.Status.Gateways = append(dst.Status.Gateways, GatewayTunnelStatus(gw))
+	}
+
+	data := peerConversionData{
+		MeshIPs:       slices.Clone(src.Status.MeshIPs),
+		MeshSubnets:   slices.Clone(src.Status.MeshSubnets),
+		ActiveGateway: src.Status.ActiveGateway,
+	}
+	if equality.Semantic.DeepEqual(data, peerConversionData{}) {
+		return nil
+	}
+	return stashConversionData(dst, data)
+}
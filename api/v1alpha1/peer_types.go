@@ -28,25 +28,83 @@ type PeerSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	// Foo is an example field of Peer. Edit peer_types.go to remove/update
-	// PublicKey is the WireGuard public key of the peer
-	PrivateKey string   `json:"privateKey"`
+	// Deprecated: PrivateKey is ignored and never stored. Private keys
+	// stay on the node, only the public key is published.
+	PrivateKey string   `json:"privateKey,omitempty"`
 	ListenPort int      `json:"listenPort"`
 	PublicKey  string   `json:"publicKey"`
 	Endpoint   string   `json:"endpoint"`
 	PodIPs     []string `json:"podIPs"`
+	// MeshIP optionally requests a specific mesh address for the peer. The
+	// address actually assigned is reported in Status.MeshIP.
 	MeshIP     string   `json:"meshIP,omitempty"`
 	AllowedIPs []string `json:"allowedIPs,omitempty"`
+	// NextPublicKey is the key the peer switches to at its next key rotation.
+	// Counterparts add it ahead of time so the switch does not drop traffic.
+	NextPublicKey string `json:"nextPublicKey,omitempty"`
 }
 
 // PeerStatus defines the observed state of Peer
 type PeerStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// MeshIP is the mesh address assigned to the peer by the controller.
+	MeshIP string `json:"meshIP,omitempty"`
+	// MeshSubnet is the mesh network MeshIP was allocated from, in CIDR notation.
+	MeshSubnet string `json:"meshSubnet,omitempty"`
+	// PublicKeyFingerprint identifies the public key currently in use.
+	PublicKeyFingerprint string `json:"publicKeyFingerprint,omitempty"`
+	// LastKeyRotationTime is when the current key was put into use.
+	LastKeyRotationTime *metav1.Time `json:"lastKeyRotationTime,omitempty"`
+	// ObservedGeneration is the generation of the spec the agent last applied.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Gateways reports the state of the tunnel to each gateway, as read from
+	// the WireGuard device.
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	Gateways []GatewayTunnelStatus `json:"gateways,omitempty"`
+	// Conditions are the Ready, InterfaceConfigured and GatewaysReachable
+	// conditions of the peer.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// Condition types reported in PeerStatus.Conditions.
+const (
+	// PeerReady is true when the interface is configured and at least one
+	// gateway is reachable.
+	PeerReady = "Ready"
+	// PeerInterfaceConfigured is true when the WireGuard device exists and
+	// carries the assigned mesh IP.
+	PeerInterfaceConfigured = "InterfaceConfigured"
+	// PeerGatewaysReachable is true when a gateway completed a handshake recently.
+	PeerGatewaysReachable = "GatewaysReachable"
+)
+
+// GatewayTunnelStatus is the state of the tunnel between a peer and a gateway.
+type GatewayTunnelStatus struct {
+	// Name of the Gateway.
+	Name string `json:"name"`
+	// LastHandshakeTime is when the last handshake with the gateway completed.
+	// +optional
+	LastHandshakeTime *metav1.Time `json:"lastHandshakeTime,omitempty"`
+	// ReceiveBytes is the number of bytes received from the gateway.
+	ReceiveBytes int64 `json:"receiveBytes"`
+	// TransmitBytes is the number of bytes sent to the gateway.
+	TransmitBytes int64 `json:"transmitBytes"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:deprecatedversion:warning="aks.azure.com/v1alpha1 Peer is deprecated, use aks.azure.com/v1alpha2"
+// +kubebuilder:printcolumn:name="Mesh IP",type=string,JSONPath=`.status.meshIP`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Gateways",type=string,JSONPath=`.status.conditions[?(@.type=="GatewaysReachable")].message`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Peer is the Schema for the peers API
 type Peer struct {
@@ -0,0 +1,138 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GatewaySpec defines the desired state of Gateway. It carries no private
+// key: the gateway keeps it in a Secret and only the public key is published.
+type GatewaySpec struct {
+	// ListenPort is the UDP port the gateway's WireGuard interface listens on.
+	ListenPort int `json:"listenPort"`
+	// PublicKey is the WireGuard public key of the gateway.
+	PublicKey string `json:"publicKey"`
+	// Endpoint is the IP address peers dial the gateway on.
+	Endpoint string `json:"endpoint"`
+	// NextPublicKey is the key the gateway switches to at its next key rotation.
+	// Counterparts add it ahead of time so the switch does not drop traffic.
+	NextPublicKey string `json:"nextPublicKey,omitempty"`
+	// MeshIP optionally requests a specific mesh address for the gateway. The
+	// address actually assigned is reported in Status.MeshIP, or in
+	// Status.MeshIPs for an IPv6 address.
+	MeshIP string `json:"meshIP,omitempty"`
+}
+
+// GatewayStatus defines the observed state of Gateway
+type GatewayStatus struct {
+	// MeshIP is the mesh address assigned to the gateway by the controller,
+	// the first of MeshIPs.
+	MeshIP string `json:"meshIP,omitempty"`
+	// MeshSubnet is the mesh network MeshIP was allocated from, in CIDR notation.
+	MeshSubnet string `json:"meshSubnet,omitempty"`
+	// MeshIPs are the mesh addresses assigned to the gateway, one per mesh
+	// network. A dual-stack mesh assigns an IPv4 and an IPv6 address.
+	MeshIPs []string `json:"meshIPs,omitempty"`
+	// MeshSubnets are the mesh networks MeshIPs were allocated from, in the
+	// same order.
+	MeshSubnets []string `json:"meshSubnets,omitempty"`
+	// PublicKeyFingerprint identifies the public key currently in use.
+	PublicKeyFingerprint string `json:"publicKeyFingerprint,omitempty"`
+	// LastKeyRotationTime is when the current key was put into use.
+	LastKeyRotationTime *metav1.Time `json:"lastKeyRotationTime,omitempty"`
+	// ListenPort is the UDP port the gateway device listens on.
+	ListenPort int `json:"listenPort,omitempty"`
+	// ConfiguredPeers is the number of Peers configured on the gateway device.
+	ConfiguredPeers int `json:"configuredPeers"`
+	// ActivePeers is the number of configured Peers that completed a
+	// handshake within the gateway's handshake timeout.
+	ActivePeers int `json:"activePeers"`
+	// NodeName is the node the gateway runs on, reported by the gateway.
+	NodeName string `json:"nodeName,omitempty"`
+	// PodName is the kube-system pod running the gateway, reported by the
+	// gateway.
+	PodName string `json:"podName,omitempty"`
+	// FailedPeers lists the Peers the gateway could not configure.
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	FailedPeers []PeerFailure `json:"failedPeers,omitempty"`
+	// Conditions are the Ready and Degraded conditions reported by the
+	// gateway, and the Valid and Reachable conditions reported by the
+	// controller.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// Condition types reported in GatewayStatus.Conditions.
+const (
+	// GatewayReady is true when the gateway device is up and listening. The
+	// controller sets it to false when the gateway pod is gone.
+	GatewayReady = "Ready"
+	// GatewayDegraded is true when some Peers could not be configured.
+	GatewayDegraded = "Degraded"
+	// GatewayValid is true when the spec is well formed.
+	GatewayValid = "Valid"
+	// GatewayReachable is true when a Peer reported a recent handshake with
+	// the gateway.
+	GatewayReachable = "Reachable"
+)
+
+// PeerFailure is a Peer the gateway could not configure.
+type PeerFailure struct {
+	// Name of the Peer.
+	Name string `json:"name"`
+	// Reason the Peer could not be configured.
+	Reason string `json:"reason"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:storageversion
+// +kubebuilder:printcolumn:name="Endpoint",type=string,JSONPath=`.spec.endpoint`
+// +kubebuilder:printcolumn:name="Mesh IP",type=string,JSONPath=`.status.meshIP`
+// +kubebuilder:printcolumn:name="Port",type=integer,JSONPath=`.status.listenPort`
+// +kubebuilder:printcolumn:name="Peers",type=integer,JSONPath=`.status.configuredPeers`
+// +kubebuilder:printcolumn:name="Active",type=integer,JSONPath=`.status.activePeers`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Degraded",type=string,JSONPath=`.status.conditions[?(@.type=="Degraded")].status`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// Gateway is the Schema for the gateways API
+type Gateway struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GatewaySpec   `json:"spec,omitempty"`
+	Status GatewayStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// GatewayList contains a list of Gateway
+type GatewayList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Gateway `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Gateway{}, &GatewayList{})
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PeerSpec defines the desired state of Peer. It carries no private key: the
+// agent keeps it on the node and only the public key is published.
+type PeerSpec struct {
+	// ListenPort is the UDP port the peer's WireGuard interface listens on.
+	ListenPort int `json:"listenPort"`
+	// PublicKey is the WireGuard public key of the peer.
+	PublicKey string `json:"publicKey"`
+	// Endpoint is the IP address counterparts dial the peer on.
+	Endpoint string   `json:"endpoint"`
+	PodIPs   []string `json:"podIPs"`
+	// MeshIP optionally requests a specific mesh address for the peer. The
+	// address actually assigned is reported in Status.MeshIP, or in
+	// Status.MeshIPs for an IPv6 address.
+	MeshIP     string   `json:"meshIP,omitempty"`
+	AllowedIPs []string `json:"allowedIPs,omitempty"`
+	// NextPublicKey is the key the peer switches to at its next key rotation.
+	// Counterparts add it ahead of time so the switch does not drop traffic.
+	NextPublicKey string `json:"nextPublicKey,omitempty"`
+}
+
+// PeerStatus defines the observed state of Peer
+type PeerStatus struct {
+	// MeshIP is the mesh address assigned to the peer by the controller,
+	// the first of MeshIPs.
+	MeshIP string `json:"meshIP,omitempty"`
+	// MeshSubnet is the mesh network MeshIP was allocated from, in CIDR notation.
+	MeshSubnet string `json:"meshSubnet,omitempty"`
+	// MeshIPs are the mesh addresses assigned to the peer, one per mesh
+	// network. A dual-stack mesh assigns an IPv4 and an IPv6 address.
+	MeshIPs []string `json:"meshIPs,omitempty"`
+	// MeshSubnets are the mesh networks MeshIPs were allocated from, in the
+	// same order.
+	MeshSubnets []string `json:"meshSubnets,omitempty"`
+	// PublicKeyFingerprint identifies the public key currently in use.
+	PublicKeyFingerprint string `json:"publicKeyFingerprint,omitempty"`
+	// LastKeyRotationTime is when the current key was put into use.
+	LastKeyRotationTime *metav1.Time `json:"lastKeyRotationTime,omitempty"`
+	// ObservedGeneration is the generation of the spec the agent last applied.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// ActiveGateway is the Gateway the peer routes mesh traffic through.
+	ActiveGateway string `json:"activeGateway,omitempty"`
+	// Gateways reports the state of the tunnel to each gateway, as read from
+	// the WireGuard device.
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	Gateways []GatewayTunnelStatus `json:"gateways,omitempty"`
+	// Conditions are the Ready, InterfaceConfigured and GatewaysReachable
+	// conditions reported by the agent, and the Valid condition reported by
+	// the controller.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// Condition types reported in PeerStatus.Conditions.
+const (
+	// PeerReady is true when the interface is configured and at least one
+	// gateway is reachable.
+	PeerReady = "Ready"
+	// PeerInterfaceConfigured is true when the WireGuard device exists and
+	// carries the assigned mesh IP.
+	PeerInterfaceConfigured = "InterfaceConfigured"
+	// PeerGatewaysReachable is true when a gateway completed a handshake recently.
+	PeerGatewaysReachable = "GatewaysReachable"
+	// PeerValid is true when the spec is well formed and does not conflict
+	// with another Peer.
+	PeerValid = "Valid"
+)
+
+// GatewayTunnelStatus is the state of the tunnel between a peer and a gateway.
+type GatewayTunnelStatus struct {
+	// Name of the Gateway.
+	Name string `json:"name"`
+	// LastHandshakeTime is when the last handshake with the gateway completed.
+	// +optional
+	LastHandshakeTime *metav1.Time `json:"lastHandshakeTime,omitempty"`
+	// ReceiveBytes is the number of bytes received from the gateway.
+	ReceiveBytes int64 `json:"receiveBytes"`
+	// TransmitBytes is the number of bytes sent to the gateway.
+	TransmitBytes int64 `json:"transmitBytes"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:storageversion
+// +kubebuilder:printcolumn:name="Mesh IP",type=string,JSONPath=`.status.meshIP`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Gateway",type=string,JSONPath=`.status.activeGateway`,priority=1
+// +kubebuilder:printcolumn:name="Gateways",type=string,JSONPath=`.status.conditions[?(@.type=="GatewaysReachable")].message`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// Peer is the Schema for the peers API
+type Peer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PeerSpec   `json:"spec,omitempty"`
+	Status PeerStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// PeerList contains a list of Peer
+type PeerList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Peer `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Peer{}, &PeerList{})
+}
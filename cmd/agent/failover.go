@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// selectGateway returns the gateway mesh traffic is routed through. Healthy
+// gateways with the lowest rank are preferred; among them the active gateway
+// is kept, otherwise the first by name takes over. Without any healthy
+// gateway the active one is kept, or the best ranked is chosen, rather than
+// dropping the route. Only gateways that have been assigned a mesh IP are
+// considered.
+func selectGateway(gateways []*v1alpha2.Gateway, active string, rank func(*v1alpha2.Gateway) int, healthy func(*v1alpha2.Gateway) bool) string {
+	candidates := make([]*v1alpha2.Gateway, 0, len(gateways))
+	for _, gateway := range gateways {
+		if gateway.Status.MeshIP != "" {
+			candidates = append(candidates, gateway)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		ri, rj := rank(candidates[i]), rank(candidates[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+
+	var current *v1alpha2.Gateway
+	for _, gateway := range candidates {
+		if gateway.Name == active {
+			current = gateway
+		}
+	}
+	for _, gateway := range candidates {
+		if !healthy(gateway) {
+			continue
+		}
+		// gateway is the best healthy one, keep the active gateway if it is
+		// as good
+		if current != nil && rank(current) == rank(gateway) && healthy(current) {
+			return current.Name
+		}
+		return gateway.Name
+	}
+	if current != nil {
+		return current.Name
+	}
+	return candidates[0].Name
+}
+
+// gatewayRank orders gateways by locality: gateways in the agent's zone come
+// first, then those in its region, then all others.
+func (a *agent) gatewayRank(gateway *v1alpha2.Gateway) int {
+	switch {
+	case a.zone != "" && gateway.Labels[v1.LabelTopologyZone] == a.zone:
+		return 0
+	case a.region != "" && gateway.Labels[v1.LabelTopologyRegion] == a.region:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// chooseGateway picks the gateway to route mesh traffic through from the
+// valid gateways, judging their health by the handshakes on the device. If
+// that is not the active gateway it also returns why the active one is left.
+func (a *agent) chooseGateway(gateways []*v1alpha2.Gateway, devPeers []wgtypes.Peer, now time.Time) (string, string) {
+	handshakes := make(map[wgtypes.Key]time.Time, len(devPeers))
+	for _, p := range devPeers {
+		handshakes[p.PublicKey] = p.LastHandshakeTime
+	}
+	unhealthy := make(map[string]string)
+	active := selectGateway(gateways, a.activeGateway, a.gatewayRank, func(gateway *v1alpha2.Gateway) bool {
+		ok, reason := a.gatewayHealth(gateway, handshakes, now)
+		if !ok {
+			unhealthy[gateway.Name] = reason
+		}
+		return ok
+	})
+	if active == a.activeGateway {
+		return active, ""
+	}
+
+	if why, ok := unhealthy[a.activeGateway]; ok {
+		return active, why
+	}
+	for _, gateway := range gateways {
+		if gateway.Name == a.activeGateway && gateway.Status.MeshIP != "" {
+			return active, fmt.Sprintf("gateway %s is closer", active)
+		}
+	}
+	return active, "gateway is gone"
+}
+
+// gatewayHealth reports whether a gateway can carry mesh traffic, and why not.
+// A gateway is unhealthy if its Gateway reports it is not ready, or if its
+// last handshake is older than the handshake timeout. A gateway added to the
+// device less than the timeout ago is given time for its first handshakes.
+// Without a recent handshake of its own the agent also trusts the Gateway's
+// Reachable condition, which lags behind the handshakes Peers report.
+func (a *agent) gatewayHealth(gateway *v1alpha2.Gateway, handshakes map[wgtypes.Key]time.Time, now time.Time) (bool, string) {
+	if gatewayCondition(gateway, v1alpha2.GatewayReady) == metav1.ConditionFalse {
+		c := meta.FindStatusCondition(gateway.Status.Conditions, v1alpha2.GatewayReady)
+		return false, fmt.Sprintf("gateway is not ready: %s", c.Message)
+	}
+
+	// a rotating gateway handshakes with either of its keys
+	var last, added time.Time
+	for _, k := range []string{gateway.Spec.PublicKey, gateway.Spec.NextPublicKey} {
+		key, err := wgtypes.ParseKey(k)
+		if err != nil {
+			continue
+		}
+		if h := handshakes[key]; h.After(last) {
+			last = h
+		}
+		if t, ok := a.gatewayAdded[key]; ok && (added.IsZero() || t.Before(added)) {
+			added = t
+		}
+	}
+	if now.Sub(last) < a.handshakeTimeout || (!added.IsZero() && now.Sub(added) < a.handshakeTimeout) {
+		return true, ""
+	}
+	if gatewayCondition(gateway, v1alpha2.GatewayReachable) == metav1.ConditionFalse {
+		c := meta.FindStatusCondition(gateway.Status.Conditions, v1alpha2.GatewayReachable)
+		return false, fmt.Sprintf("gateway is not reachable: %s", c.Message)
+	}
+	if last.IsZero() {
+		return false, "no handshake completed"
+	}
+	return false, fmt.Sprintf("last handshake %s ago", now.Sub(last).Round(time.Second))
+}
+
+// trackGatewayPeers records when each gateway peer key was first configured
+// and forgets keys that are no longer configured.
+func (a *agent) trackGatewayPeers(keys map[wgtypes.Key]struct{}, now time.Time) {
+	for key := range keys {
+		if _, ok := a.gatewayAdded[key]; !ok {
+			a.gatewayAdded[key] = now
+		}
+	}
+	for key := range a.gatewayAdded {
+		if _, ok := keys[key]; !ok {
+			delete(a.gatewayAdded, key)
+		}
+	}
+}
+
+// gatewayFailoverPending reports whether the health of the gateways calls for
+// routing mesh traffic through a different gateway.
+func (a *agent) gatewayFailoverPending(ctx context.Context) (bool, error) {
+	var gatewayList v1alpha2.GatewayList
+	if err := a.informers.List(ctx, &gatewayList); err != nil {
+		return false, fmt.Errorf("fetching Gateways: %w", err)
+	}
+	wgdev, err := a.wg.Device(agentInfName)
+	if err != nil {
+		return false, fmt.Errorf("getting WireGuard device: %w", err)
+	}
+
+	valid := make([]*v1alpha2.Gateway, 0, len(gatewayList.Items))
+	for _, gateway := range a.assignedGateways(gatewayList.Items, wgdev.PublicKey) {
+		if _, err := gatewayPeerConfigs(gateway, a.keepalive); err == nil {
+			valid = append(valid, gateway)
+		}
+	}
+	active, _ := a.chooseGateway(valid, wgdev.Peers, time.Now())
+	return active != a.activeGateway, nil
+}
+
+// switchGateway makes active the gateway mesh traffic is routed through and
+// records an Event on the Peer explaining the switch.
+func (a *agent) switchGateway(ctx context.Context, active, why string) {
+	previous := a.activeGateway
+	a.activeGateway = active
+
+	eventType, reason, message := v1.EventTypeNormal, "GatewaySelected", fmt.Sprintf("Routing mesh traffic through gateway %s", active)
+	switch {
+	case active == "":
+		eventType, reason, message = v1.EventTypeWarning, "NoGateway", "No gateway with a mesh IP is available to route mesh traffic"
+	case previous != "":
+		eventType, reason = v1.EventTypeWarning, "GatewayFailover"
+		message = fmt.Sprintf("Failing over mesh traffic from gateway %s (%s) to gateway %s", previous, why, active)
+	}
+	log.Print(message)
+
+	var peer v1alpha2.Peer
+	key := client.ObjectKey{Name: a.nodeName, Namespace: metav1.NamespaceSystem}
+	if err := a.client.Get(ctx, key, &peer); err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Printf("Error getting Peer resource for gateway event: %v", err)
+		}
+		return
+	}
+	a.recorder.Event(&peer, eventType, reason, message)
+}
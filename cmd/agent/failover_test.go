@@ -0,0 +1,271 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testGateway(name, zone string, conditions ...metav1.Condition) *v1alpha2.Gateway {
+	return &v1alpha2.Gateway{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{v1.LabelTopologyZone: zone}},
+		Status:     v1alpha2.GatewayStatus{MeshIP: "100.255.224.1", Conditions: conditions},
+	}
+}
+
+func testKey(t *testing.T) wgtypes.Key {
+	t.Helper()
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.PublicKey()
+}
+
+func TestSelectGateway(t *testing.T) {
+	a := &agent{zone: "zone-1"}
+	noMeshIP := testGateway("gw-0", "zone-1")
+	noMeshIP.Status.MeshIP = ""
+
+	tests := []struct {
+		name      string
+		gateways  []*v1alpha2.Gateway
+		active    string
+		unhealthy []string
+		want      string
+	}{
+		{
+			name:     "no gateways",
+			gateways: nil,
+			want:     "",
+		},
+		{
+			name:     "sticks with the healthy active gateway",
+			gateways: []*v1alpha2.Gateway{testGateway("gw-a", "zone-1"), testGateway("gw-b", "zone-1")},
+			active:   "gw-b",
+			want:     "gw-b",
+		},
+		{
+			name:     "prefers a gateway in the agent's zone",
+			gateways: []*v1alpha2.Gateway{testGateway("gw-a", "zone-2"), testGateway("gw-b", "zone-1")},
+			want:     "gw-b",
+		},
+		{
+			name:     "moves to a healthy gateway in the agent's zone",
+			gateways: []*v1alpha2.Gateway{testGateway("gw-a", "zone-2"), testGateway("gw-b", "zone-1")},
+			active:   "gw-a",
+			want:     "gw-b",
+		},
+		{
+			name:      "fails over from an unhealthy active gateway",
+			gateways:  []*v1alpha2.Gateway{testGateway("gw-a", "zone-1"), testGateway("gw-b", "zone-2")},
+			active:    "gw-a",
+			unhealthy: []string{"gw-a"},
+			want:      "gw-b",
+		},
+		{
+			name:     "breaks ties by name",
+			gateways: []*v1alpha2.Gateway{testGateway("gw-b", "zone-1"), testGateway("gw-a", "zone-1")},
+			want:     "gw-a",
+		},
+		{
+			name:      "keeps the active gateway when every gateway is unhealthy",
+			gateways:  []*v1alpha2.Gateway{testGateway("gw-a", "zone-1"), testGateway("gw-b", "zone-2")},
+			active:    "gw-b",
+			unhealthy: []string{"gw-a", "gw-b"},
+			want:      "gw-b",
+		},
+		{
+			name:      "picks the best ranked gateway when every gateway is unhealthy",
+			gateways:  []*v1alpha2.Gateway{testGateway("gw-a", "zone-2"), testGateway("gw-b", "zone-1")},
+			unhealthy: []string{"gw-a", "gw-b"},
+			want:      "gw-b",
+		},
+		{
+			name:     "skips gateways without a mesh IP",
+			gateways: []*v1alpha2.Gateway{noMeshIP, testGateway("gw-a", "zone-2")},
+			want:     "gw-a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			healthy := func(gateway *v1alpha2.Gateway) bool {
+				for _, name := range tt.unhealthy {
+					if gateway.Name == name {
+						return false
+					}
+				}
+				return true
+			}
+			if got := selectGateway(tt.gateways, tt.active, a.gatewayRank, healthy); got != tt.want {
+				t.Errorf("selectGateway() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGatewayHealth(t *testing.T) {
+	now := time.Now()
+	key, nextKey := testKey(t), testKey(t)
+	notReady := metav1.Condition{Type: v1alpha2.GatewayReady, Status: metav1.ConditionFalse, Message: "pod gone"}
+	unreachable := metav1.Condition{Type: v1alpha2.GatewayReachable, Status: metav1.ConditionFalse, Message: "no handshakes"}
+
+	tests := []struct {
+		name       string
+		conditions []metav1.Condition
+		handshake  time.Time
+		// nextKeyHandshake is a handshake with the gateway's next key.
+		nextKeyHandshake time.Time
+		added            time.Time
+		want             bool
+		wantReason       string
+	}{
+		{
+			name:      "recent handshake",
+			handshake: now.Add(-time.Minute),
+			added:     now.Add(-time.Hour),
+			want:      true,
+		},
+		{
+			name:       "stale handshake",
+			handshake:  now.Add(-5 * time.Minute),
+			added:      now.Add(-time.Hour),
+			wantReason: "last handshake 5m0s ago",
+		},
+		{
+			name:  "new gateway within the grace period",
+			added: now.Add(-time.Minute),
+			want:  true,
+		},
+		{
+			name:       "no handshake after the grace period",
+			added:      now.Add(-time.Hour),
+			wantReason: "no handshake completed",
+		},
+		{
+			name:             "recent handshake with the next key",
+			handshake:        now.Add(-time.Hour),
+			nextKeyHandshake: now.Add(-time.Minute),
+			added:            now.Add(-time.Hour),
+			want:             true,
+		},
+		{
+			name:       "not ready despite a recent handshake",
+			conditions: []metav1.Condition{notReady},
+			handshake:  now.Add(-time.Minute),
+			added:      now.Add(-time.Hour),
+			wantReason: "gateway is not ready: pod gone",
+		},
+		{
+			name:       "unreachable by every Peer",
+			conditions: []metav1.Condition{unreachable},
+			handshake:  now.Add(-5 * time.Minute),
+			added:      now.Add(-time.Hour),
+			wantReason: "gateway is not reachable: no handshakes",
+		},
+		{
+			name:       "reported unreachable despite a recent handshake",
+			conditions: []metav1.Condition{unreachable},
+			handshake:  now.Add(-time.Minute),
+			added:      now.Add(-time.Hour),
+			want:       true,
+		},
+		{
+			name:       "unreachable new gateway within the grace period",
+			conditions: []metav1.Condition{unreachable},
+			added:      now.Add(-time.Minute),
+			want:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &agent{
+				handshakeTimeout: 3 * time.Minute,
+				gatewayAdded:     map[wgtypes.Key]time.Time{key: tt.added},
+			}
+			gateway := testGateway("gw-a", "zone-1", tt.conditions...)
+			gateway.Spec.PublicKey = key.String()
+			gateway.Spec.NextPublicKey = nextKey.String()
+			handshakes := map[wgtypes.Key]time.Time{key: tt.handshake, nextKey: tt.nextKeyHandshake}
+
+			got, reason := a.gatewayHealth(gateway, handshakes, now)
+			if got != tt.want || reason != tt.wantReason {
+				t.Errorf("gatewayHealth() = %v, %q, want %v, %q", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestChooseGateway(t *testing.T) {
+	now := time.Now()
+	keyA, keyB := testKey(t), testKey(t)
+	gwA, gwB := testGateway("gw-a", "zone-1"), testGateway("gw-b", "zone-2")
+	gwA.Spec.PublicKey, gwB.Spec.PublicKey = keyA.String(), keyB.String()
+	recent := []wgtypes.Peer{
+		{PublicKey: keyA, LastHandshakeTime: now.Add(-time.Minute)},
+		{PublicKey: keyB, LastHandshakeTime: now.Add(-time.Minute)},
+	}
+	staleA := []wgtypes.Peer{
+		{PublicKey: keyA, LastHandshakeTime: now.Add(-time.Hour)},
+		{PublicKey: keyB, LastHandshakeTime: now.Add(-time.Minute)},
+	}
+
+	tests := []struct {
+		name     string
+		gateways []*v1alpha2.Gateway
+		devPeers []wgtypes.Peer
+		active   string
+		want     string
+		wantWhy  string
+	}{
+		{
+			name:     "keeps the active gateway",
+			gateways: []*v1alpha2.Gateway{gwA, gwB},
+			devPeers: recent,
+			active:   "gw-a",
+			want:     "gw-a",
+		},
+		{
+			name:     "leaves an unhealthy active gateway",
+			gateways: []*v1alpha2.Gateway{gwA, gwB},
+			devPeers: staleA,
+			active:   "gw-a",
+			want:     "gw-b",
+			wantWhy:  "last handshake 1h0m0s ago",
+		},
+		{
+			name:     "moves to a closer gateway",
+			gateways: []*v1alpha2.Gateway{gwA, gwB},
+			devPeers: recent,
+			active:   "gw-b",
+			want:     "gw-a",
+			wantWhy:  "gateway gw-a is closer",
+		},
+		{
+			name:     "replaces a removed gateway",
+			gateways: []*v1alpha2.Gateway{gwB},
+			devPeers: recent,
+			active:   "gw-a",
+			want:     "gw-b",
+			wantWhy:  "gateway is gone",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &agent{
+				zone:             "zone-1",
+				activeGateway:    tt.active,
+				handshakeTimeout: 3 * time.Minute,
+				gatewayAdded:     map[wgtypes.Key]time.Time{keyA: now.Add(-time.Hour), keyB: now.Add(-time.Hour)},
+			}
+			got, why := a.chooseGateway(tt.gateways, tt.devPeers, now)
+			if got != tt.want || why != tt.wantWhy {
+				t.Errorf("chooseGateway() = %q, %q, want %q, %q", got, why, tt.want, tt.wantWhy)
+			}
+		})
+	}
+}
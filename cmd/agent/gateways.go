@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/hashring"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/meshaddr"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// watchGateways starts an informer on Gateway objects and waits for its cache
+// to sync. Every add, spec change or delete signals meshChanged.
+func (a *agent) watchGateways(ctx context.Context, cfg *rest.Config) error {
+	c, err := cache.New(cfg, cache.Options{Scheme: scheme})
+	if err != nil {
+		return fmt.Errorf("creating gateway cache: %w", err)
+	}
+
+	informer, err := c.GetInformer(ctx, &v1alpha2.Gateway{})
+	if err != nil {
+		return fmt.Errorf("creating gateway informer: %w", err)
+	}
+	_, err = informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { a.notifyMeshChanged() },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldGw, ok1 := oldObj.(*v1alpha2.Gateway)
+			newGw, ok2 := newObj.(*v1alpha2.Gateway)
+			// besides the spec only the mesh IP, readiness, reachability and
+			// topology of a gateway affect the device
+			if ok1 && ok2 && oldGw.Generation == newGw.Generation &&
+				oldGw.Status.MeshIP == newGw.Status.MeshIP && slices.Equal(oldGw.Status.MeshIPs, newGw.Status.MeshIPs) &&
+				gatewayCondition(oldGw, v1alpha2.GatewayReady) == gatewayCondition(newGw, v1alpha2.GatewayReady) &&
+				gatewayCondition(oldGw, v1alpha2.GatewayReachable) == gatewayCondition(newGw, v1alpha2.GatewayReachable) &&
+				oldGw.Labels[v1.LabelTopologyZone] == newGw.Labels[v1.LabelTopologyZone] &&
+				oldGw.Labels[v1.LabelTopologyRegion] == newGw.Labels[v1.LabelTopologyRegion] {
+				return
+			}
+			a.notifyMeshChanged()
+		},
+		DeleteFunc: func(obj interface{}) { a.notifyMeshChanged() },
+	})
+	if err != nil {
+		return fmt.Errorf("registering gateway event handler: %w", err)
+	}
+
+	go func() {
+		if err := c.Start(ctx); err != nil {
+			log.Printf("Gateway cache stopped: %v", err)
+		}
+	}()
+	if !c.WaitForCacheSync(ctx) {
+		return fmt.Errorf("gateway cache did not sync")
+	}
+
+	a.informers = c
+	return nil
+}
+
+// gatewayCondition returns the status of the Gateway's condition of the
+// given type.
+func gatewayCondition(gateway *v1alpha2.Gateway, conditionType string) metav1.ConditionStatus {
+	if c := meta.FindStatusCondition(gateway.Status.Conditions, conditionType); c != nil {
+		return c.Status
+	}
+	return metav1.ConditionUnknown
+}
+
+func (a *agent) notifyMeshChanged() {
+	select {
+	case a.meshChanged <- struct{}{}:
+	default:
+		// a sync is already pending
+	}
+}
+
+// ensurePeering makes the device peers match the Gateway list and, in full
+// mesh mode, the Peer list. Gateways and Peers with an invalid key or
+// endpoint are skipped and reported, the others are still configured. On
+// error the device is left as it was, so the existing tunnels stay up until
+// the next attempt.
+func (a *agent) ensurePeering(ctx context.Context) error {
+	fmt.Println("Ensuring peering...")
+
+	var gatewayList v1alpha2.GatewayList
+	if err := a.informers.List(ctx, &gatewayList); err != nil {
+		return fmt.Errorf("fetching Gateways: %w", err)
+	}
+
+	wgdev, err := a.wg.Device(agentInfName)
+	if err != nil {
+		return fmt.Errorf("getting WireGuard device: %w", err)
+	}
+
+	// build the full set of peers the device should have, one per Gateway
+	// assigned to this node
+	valid := make([]*v1alpha2.Gateway, 0, len(gatewayList.Items))
+	gatewayPeers := make(map[string][]wgtypes.PeerConfig, len(gatewayList.Items))
+	for _, gateway := range a.assignedGateways(gatewayList.Items, wgdev.PublicKey) {
+		fmt.Printf("Configuring peering with gateway: %s (Endpoint: %s, PublicKey: %s, MeshIPs: %v)\n", gateway.Name, gateway.Spec.Endpoint, gateway.Spec.PublicKey, gateway.Status.MeshIPs)
+		gwPeers, err := gatewayPeerConfigs(gateway, a.keepalive)
+		if err != nil {
+			log.Printf("Skipping gateway %s: %v", gateway.Name, err)
+			a.recorder.Eventf(gateway, v1.EventTypeWarning, "InvalidGateway",
+				"Agent on node %s skipped gateway: %v", a.nodeName, err)
+			continue
+		}
+		valid = append(valid, gateway)
+		gatewayPeers[gateway.Name] = gwPeers
+	}
+
+	// every gateway is reachable on its own mesh IP, which is more specific
+	// than the mesh networks; the rest of those can only be routed through
+	// one of them
+	active, why := a.chooseGateway(valid, wgdev.Peers, time.Now())
+	gatewayKeys := make(map[wgtypes.Key]struct{}, len(gatewayList.Items))
+	peers := make([]wgtypes.PeerConfig, 0, len(gatewayList.Items))
+	for _, gateway := range valid {
+		gwPeers := gatewayPeers[gateway.Name]
+		if gateway.Name == active {
+			gwPeers[0].AllowedIPs = append(gwPeers[0].AllowedIPs, a.meshRoutes...)
+		}
+		for _, cfg := range gwPeers {
+			gatewayKeys[cfg.PublicKey] = struct{}{}
+			peers = append(peers, cfg)
+		}
+	}
+
+	meshPeers, podRoutes, err := a.meshPeers(ctx)
+	if err != nil {
+		return err
+	}
+	peers = append(peers, meshPeers...)
+	desired := make(map[wgtypes.Key]struct{}, len(peers))
+	for _, cfg := range peers {
+		desired[cfg.PublicKey] = struct{}{}
+	}
+
+	// health checks and status updates of Gateways mostly leave the peers
+	// as they are, the device is only reconfigured when they change
+	if !peersConfigured(wgdev.Peers, peers) {
+		// drop peers of gateways and nodes that were deleted or rotated their key
+		for _, p := range wgdev.Peers {
+			if _, ok := desired[p.PublicKey]; !ok {
+				fmt.Printf("Removing stale peer: %s\n", p.PublicKey)
+				peers = append(peers, wgtypes.PeerConfig{PublicKey: p.PublicKey, Remove: true})
+			}
+		}
+
+		err = a.wg.ConfigureDevice(wgdev.Name, wgtypes.Config{
+			Peers:        peers,
+			ReplacePeers: false,
+		})
+		if err != nil {
+			return fmt.Errorf("configuring peering: %w", err)
+		}
+	}
+	a.trackGatewayPeers(gatewayKeys, time.Now())
+	// only a switch the device has taken is recorded, a failed one is retried
+	// on the next sync
+	if active != a.activeGateway {
+		a.switchGateway(ctx, active, why)
+	}
+
+	// the device only accepts pod traffic the kernel routes into it
+	if err := ensurePodRoutes(podRoutes); err != nil {
+		return err
+	}
+
+	fmt.Println("Peering ensured.")
+	return nil
+}
+
+// peersConfigured reports whether the device peers are exactly peers, with
+// the same endpoints, keepalives and allowed IPs.
+func peersConfigured(devPeers []wgtypes.Peer, peers []wgtypes.PeerConfig) bool {
+	if len(devPeers) != len(peers) {
+		return false
+	}
+	byKey := make(map[wgtypes.Key]wgtypes.Peer, len(devPeers))
+	for _, p := range devPeers {
+		byKey[p.PublicKey] = p
+	}
+	for _, cfg := range peers {
+		p, ok := byKey[cfg.PublicKey]
+		if !ok {
+			return false
+		}
+		if (cfg.Endpoint == nil) != (p.Endpoint == nil) ||
+			(cfg.Endpoint != nil && (!cfg.Endpoint.IP.Equal(p.Endpoint.IP) || cfg.Endpoint.Port != p.Endpoint.Port)) {
+			return false
+		}
+		var keepalive time.Duration
+		if cfg.PersistentKeepaliveInterval != nil {
+			keepalive = *cfg.PersistentKeepaliveInterval
+		}
+		if keepalive != p.PersistentKeepaliveInterval {
+			return false
+		}
+		want := make([]string, 0, len(cfg.AllowedIPs))
+		for _, ipNet := range cfg.AllowedIPs {
+			want = append(want, ipNet.String())
+		}
+		got := make([]string, 0, len(p.AllowedIPs))
+		for _, ipNet := range p.AllowedIPs {
+			got = append(got, ipNet.String())
+		}
+		slices.Sort(want)
+		slices.Sort(got)
+		if !slices.Equal(want, got) {
+			return false
+		}
+	}
+	return true
+}
+
+// assignedGateways returns the gateways this node peers with. With sharding
+// every node is assigned gatewaysPerPeer gateways by consistent hashing over
+// all Gateways, the same ring the gateways use to pick their Peers.
+func (a *agent) assignedGateways(gateways []v1alpha2.Gateway, publicKey wgtypes.Key) []*v1alpha2.Gateway {
+	names := make([]string, 0, len(gateways))
+	for _, gateway := range gateways {
+		names = append(names, gateway.Name)
+	}
+	ring := hashring.New(names, hashring.DefaultVirtualNodes)
+	key := hashring.PeerKey(a.shardKey, a.nodeName, publicKey.String())
+
+	assigned := make([]*v1alpha2.Gateway, 0, len(gateways))
+	for i := range gateways {
+		if a.gatewaysPerPeer > 0 && !ring.Owns(gateways[i].Name, key, a.gatewaysPerPeer) {
+			continue
+		}
+		assigned = append(assigned, &gateways[i])
+	}
+	return assigned
+}
+
+// gatewayPeerConfigs returns the device peers for a gateway, or an error if
+// the gateway does not advertise a usable key and endpoint. The first peer
+// routes the gateway's own mesh IPs. keepalive makes the tunnel handshake even
+// while idle, so its health can be judged by the last handshake.
+func gatewayPeerConfigs(gateway *v1alpha2.Gateway, keepalive time.Duration) ([]wgtypes.PeerConfig, error) {
+	publicKey, err := wgtypes.ParseKey(gateway.Spec.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %q: %w", gateway.Spec.PublicKey, err)
+	}
+	ip := net.ParseIP(gateway.Spec.Endpoint)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid endpoint %q", gateway.Spec.Endpoint)
+	}
+	port := gateway.Spec.ListenPort
+	if port == 0 {
+		port = defaultGatewayPort
+	}
+
+	cfg := wgtypes.PeerConfig{
+		PublicKey:                   publicKey,
+		Endpoint:                    &net.UDPAddr{IP: ip, Port: port},
+		PersistentKeepaliveInterval: &keepalive,
+		ReplaceAllowedIPs:           true,
+	}
+	meshIPs, err := meshaddr.Addrs(gateway.Status.MeshIP, "", gateway.Status.MeshIPs, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, meshIP := range meshIPs {
+		cfg.AllowedIPs = append(cfg.AllowedIPs, meshaddr.HostNet(meshIP.IP))
+	}
+	if gateway.Spec.NextPublicKey == "" {
+		return []wgtypes.PeerConfig{cfg}, nil
+	}
+
+	// accept handshakes from the gateway's next key ahead of its rotation, it
+	// takes over the allowed IPs once it is current
+	nextKey, err := wgtypes.ParseKey(gateway.Spec.NextPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid next public key %q: %w", gateway.Spec.NextPublicKey, err)
+	}
+	next := wgtypes.PeerConfig{
+		PublicKey:                   nextKey,
+		Endpoint:                    cfg.Endpoint,
+		PersistentKeepaliveInterval: &keepalive,
+		ReplaceAllowedIPs:           true,
+	}
+	return []wgtypes.PeerConfig{cfg, next}, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPeersConfigured(t *testing.T) {
+	keyA, keyB := testKey(t), testKey(t)
+	keepalive := 25 * time.Second
+	endpoint := &net.UDPAddr{IP: net.ParseIP("10.224.0.4"), Port: 51820}
+	cidr := func(s string) net.IPNet {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *ipNet
+	}
+	peers := []wgtypes.PeerConfig{{
+		PublicKey:                   keyA,
+		Endpoint:                    endpoint,
+		PersistentKeepaliveInterval: &keepalive,
+		ReplaceAllowedIPs:           true,
+		AllowedIPs:                  []net.IPNet{cidr("100.255.224.1/32"), cidr("100.255.224.0/19")},
+	}}
+	device := func() []wgtypes.Peer {
+		return []wgtypes.Peer{{
+			PublicKey:                   keyA,
+			Endpoint:                    &net.UDPAddr{IP: net.ParseIP("10.224.0.4"), Port: 51820},
+			PersistentKeepaliveInterval: keepalive,
+			// the device may list the allowed IPs in another order
+			AllowedIPs: []net.IPNet{cidr("100.255.224.0/19"), cidr("100.255.224.1/32")},
+		}}
+	}
+
+	tests := []struct {
+		name   string
+		modify func([]wgtypes.Peer) []wgtypes.Peer
+		want   bool
+	}{
+		{name: "unchanged", modify: func(p []wgtypes.Peer) []wgtypes.Peer { return p }, want: true},
+		{name: "missing peer", modify: func([]wgtypes.Peer) []wgtypes.Peer { return nil }},
+		{name: "extra peer", modify: func(p []wgtypes.Peer) []wgtypes.Peer { return append(p, wgtypes.Peer{PublicKey: keyB}) }},
+		{name: "other key", modify: func(p []wgtypes.Peer) []wgtypes.Peer { p[0].PublicKey = keyB; return p }},
+		{name: "other endpoint", modify: func(p []wgtypes.Peer) []wgtypes.Peer { p[0].Endpoint.Port = 51821; return p }},
+		{name: "no keepalive", modify: func(p []wgtypes.Peer) []wgtypes.Peer { p[0].PersistentKeepaliveInterval = 0; return p }},
+		{name: "mesh route moved away", modify: func(p []wgtypes.Peer) []wgtypes.Peer { p[0].AllowedIPs = p[0].AllowedIPs[1:]; return p }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := peersConfigured(tt.modify(device()), peers); got != tt.want {
+				t.Errorf("peersConfigured() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
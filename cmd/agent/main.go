@@ -3,17 +3,23 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha1"
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
 	"github.com/t-chdossa_microsoft/aks-mesh/pkg/acn"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/hashring"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/keystore"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/meshaddr"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/podaddrs"
 	"github.com/vishvananda/netlink"
 
 	"golang.zx2c4.com/wireguard/wgctrl"
@@ -21,10 +27,17 @@ import (
 	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -32,11 +45,39 @@ var scheme = runtime.NewScheme()
 
 func init() {
 	_ = clientgoscheme.AddToScheme(scheme)
-	_ = v1alpha1.AddToScheme(scheme)
+	_ = v1alpha2.AddToScheme(scheme)
 }
 
 const agentInfName = "wga" // "wireguardagent"
 
+const (
+	// defaultListenPort is the port agents listen on unless configured otherwise.
+	defaultListenPort = 51821
+	// defaultGatewayPort is dialed for Gateways that do not advertise a port.
+	defaultGatewayPort = 51820
+)
+
+const (
+	// podAddrSourceNNC reads the pod addresses from the Azure CNI
+	// NodeNetworkConfig of the node.
+	podAddrSourceNNC = "nnc"
+	// podAddrSourceNode reads the pod CIDRs from the Node spec.
+	podAddrSourceNode = "node"
+	// podAddrSourceStatic uses the addresses given in --pod-addresses.
+	podAddrSourceStatic = "static"
+)
+
+// errMeshIPPending is returned until the controller assigns a mesh IP.
+var errMeshIPPending = errors.New("mesh IP not assigned yet")
+
+// errNodeIPPending is returned until the kubelet reports the node's internal
+// IP.
+var errNodeIPPending = errors.New("node internal IP not found")
+
+// keyRotationCheckInterval is how often the agent checks whether its key is
+// due for rotation.
+const keyRotationCheckInterval = time.Minute
+
 type WireGuard struct {
 	Attributes *netlink.LinkAttrs
 }
@@ -51,56 +92,358 @@ func (w *WireGuard) Type() string {
 
 var _ netlink.Link = &WireGuard{}
 
+// agent holds the long lived clients shared by the setup steps and the
+// gateway sync loop.
+type agent struct {
+	nodeName   string
+	listenPort int
+	client     client.Client
+	wg         *wgctrl.Client
+	// keys persists the device private key across interface re-creation.
+	keys keystore.Store
+	// rotator replaces the private key on a schedule.
+	rotator *keystore.Rotator
+	// recorder emits Events about Gateways the agent cannot peer with.
+	recorder record.EventRecorder
+	// podAddrs reports the pod addresses of the node, advertised as the Peer's
+	// allowed IPs.
+	podAddrs podaddrs.Source
+	// podAddrsChanged is signalled when podAddrs reports a change.
+	podAddrsChanged chan struct{}
+
+	// meshMode is meshModeHub or meshModeFull.
+	meshMode string
+	// informers is an informer backed cache of all Gateway objects and, in
+	// full mesh mode, of all Peer objects.
+	informers cache.Cache
+	// meshChanged is signalled whenever a Gateway, or in full mesh mode a
+	// Peer, is added, changed or removed. It is buffered so bursts of events
+	// collapse into one sync.
+	meshChanged chan struct{}
+	// activeGateway is the gateway mesh traffic is currently routed through.
+	activeGateway string
+	// meshRoutes are the mesh networks from the Peer's status.meshSubnets,
+	// routed through the active gateway.
+	meshRoutes []net.IPNet
+	// gatewayAdded is when each gateway peer key was first configured.
+	gatewayAdded map[wgtypes.Key]time.Time
+	// handshakeTimeout is how long after its last handshake a gateway still
+	// counts as healthy.
+	handshakeTimeout time.Duration
+	// keepalive is the persistent keepalive interval of gateway peers.
+	keepalive time.Duration
+	// zone and region are the topology of the node, gateways in the same
+	// zone or region are preferred.
+	zone, region string
+	// nodeUID identifies the node the Peer belongs to, so that the Peer is
+	// garbage collected with the node.
+	nodeUID types.UID
+	// gatewaysPerPeer is how many gateways the agent peers with, picked by
+	// consistent hashing of shardKey. Zero peers with all gateways.
+	gatewaysPerPeer int
+	shardKey        string
+	// endpointIPv6 publishes the node's IPv6 internal IP as the Peer endpoint
+	// instead of its IPv4 one.
+	endpointIPv6 bool
+}
+
 func main() {
-	// Create a channel to receive OS signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	var (
+		resyncPeriod       time.Duration
+		statusInterval     time.Duration
+		listenPort         int
+		keyFile            string
+		rotateKey          bool
+		keyRotationPeriod  time.Duration
+		keyRotationOverlap time.Duration
+		handshakeTimeout   time.Duration
+		keepalive          time.Duration
+		healthInterval     time.Duration
+		meshMode           string
+		gatewaysPerPeer    int
+		shardKey           string
+		endpointFamily     string
+		podAddrSource      string
+		podAddrs           string
+		nncNamespace       string
+	)
+	flag.DurationVar(&resyncPeriod, "resync-period", 5*time.Minute,
+		"Interval at which peering is re-checked even if no Gateway or Peer changed")
+	flag.DurationVar(&statusInterval, "status-interval", time.Minute,
+		"Interval at which tunnel state and conditions are reported in the Peer status")
+	flag.IntVar(&listenPort, "listen-port", defaultListenPort,
+		"UDP port the WireGuard interface listens on, published in the Peer resource")
+	flag.StringVar(&keyFile, "key-file", "/var/lib/aks-mesh/agent.key",
+		"Node-local file holding the WireGuard private key, usually on a hostPath volume")
+	flag.BoolVar(&rotateKey, "rotate-key", false,
+		"Generate a new private key and replace the one stored in key-file")
+	flag.DurationVar(&keyRotationPeriod, "key-rotation-period", 0,
+		"Lifetime of the WireGuard private key before it is rotated automatically, 0 disables rotation")
+	flag.DurationVar(&keyRotationOverlap, "key-rotation-overlap", 2*time.Minute,
+		"How long the next public key is published before the agent switches to it")
+	flag.DurationVar(&handshakeTimeout, "gateway-handshake-timeout", 3*time.Minute,
+		"How long after its last handshake a gateway is considered down and mesh traffic fails over to another gateway")
+	flag.DurationVar(&keepalive, "gateway-keepalive", 25*time.Second,
+		"Persistent keepalive interval of gateway tunnels, keeps idle tunnels handshaking so their health is known")
+	flag.DurationVar(&healthInterval, "gateway-health-interval", 10*time.Second,
+		"Interval at which the health of the active gateway is checked")
+	flag.StringVar(&meshMode, "mesh-mode", meshModeHub,
+		"Set to \"full\" to also peer directly with every other node, or \"hub\" to only peer with gateways; must be the same on all nodes")
+	flag.IntVar(&gatewaysPerPeer, "gateways-per-peer", 0,
+		"Number of gateways each node peers with, assigned by consistent hashing; 0 peers with every gateway. Must match the gateways' setting")
+	flag.StringVar(&shardKey, "shard-key", hashring.ShardKeyNodeName,
+		"What nodes are assigned to gateways by, \"node-name\" or \"public-key\". Must match the gateways' setting; \"public-key\" cannot be used with --key-rotation-period")
+	flag.StringVar(&endpointFamily, "endpoint-ip-family", "ipv4",
+		"IP family of the node internal IP published as the Peer endpoint, \"ipv4\" or \"ipv6\"; falls back to the first internal IP")
+	flag.StringVar(&podAddrSource, "pod-address-source", podAddrSourceNNC,
+		"Where the node's pod addresses come from: \"nnc\" for the Azure CNI NodeNetworkConfig, \"node\" for the Node's spec.podCIDRs or \"static\" for --pod-addresses")
+	flag.StringVar(&podAddrs, "pod-addresses", "",
+		"Comma separated pod addresses or CIDRs of the node, used with --pod-address-source=static")
+	flag.StringVar(&nncNamespace, "nnc-namespace", acn.DefaultNamespace,
+		"Namespace of the NodeNetworkConfigs read with --pod-address-source=nnc")
+	flag.Parse()
+	if podAddrSource != podAddrSourceNNC && podAddrSource != podAddrSourceNode && podAddrSource != podAddrSourceStatic {
+		log.Fatalf("Invalid --pod-address-source %q, must be %q, %q or %q", podAddrSource, podAddrSourceNNC, podAddrSourceNode, podAddrSourceStatic)
+	}
+	if endpointFamily != "ipv4" && endpointFamily != "ipv6" {
+		log.Fatalf("Invalid --endpoint-ip-family %q, must be \"ipv4\" or \"ipv6\"", endpointFamily)
+	}
+	if shardKey != hashring.ShardKeyNodeName && shardKey != hashring.ShardKeyPublicKey {
+		log.Fatalf("Invalid --shard-key %q, must be %q or %q", shardKey, hashring.ShardKeyNodeName, hashring.ShardKeyPublicKey)
+	}
+	if shardKey == hashring.ShardKeyPublicKey && keyRotationPeriod > 0 {
+		// The public key changes on every rotation, so the agent and the gateways
+		// would hash different keys until the new Peer spec reaches them.
+		log.Fatalf("Invalid --shard-key %q with --key-rotation-period, must be %q", shardKey, hashring.ShardKeyNodeName)
+	}
+	if meshMode != meshModeHub && meshMode != meshModeFull {
+		log.Fatalf("Invalid --mesh-mode %q, must be %q or %q", meshMode, meshModeHub, meshModeFull)
+	}
+
+	// ctx is cancelled on SIGTERM or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
 	fmt.Println("Starting WireGuard agent setup...")
-	ensureWireGuardInterface()
-	ensurePeeringWithGateways()
-	createPeerResource()
+	a, err := newAgent(ctx, listenPort, meshMode, podAddrConfig{
+		source:       podAddrSource,
+		static:       splitList(podAddrs),
+		nncNamespace: nncNamespace,
+	}, &keystore.Rotator{
+		Current: &keystore.FileStore{Path: keyFile},
+		Next:    &keystore.FileStore{Path: keyFile + ".next"},
+		Period:  keyRotationPeriod,
+		Overlap: keyRotationOverlap,
+	})
+	if err != nil {
+		log.Fatalf("Error initializing agent: %v", err)
+	}
+	defer a.wg.Close()
+	a.handshakeTimeout = handshakeTimeout
+	a.keepalive = keepalive
+	a.gatewaysPerPeer = gatewaysPerPeer
+	a.shardKey = shardKey
+	a.endpointIPv6 = endpointFamily == "ipv6"
+
+	// transient failures are retried with backoff, only errors that cannot
+	// resolve themselves stop the agent
+	steps := []struct {
+		what string
+		run  func(context.Context) error
+	}{
+		{"ensure WireGuard interface", a.ensureWireGuardInterface},
+		{"rotate private key", func(ctx context.Context) error {
+			if !rotateKey {
+				return nil
+			}
+			log.Default().Println("Rotating private key for WireGuard device...")
+			_, err := keystore.Rotate(ctx, a.keys)
+			return err
+		}},
+		{"ensure private key", a.ensurePrivateKey},
+		{"get node topology", a.ensureTopology},
+		{"ensure peering", a.ensurePeering},
+		{"create Peer resource", a.createPeerResource},
+		{"ensure mesh IP", a.ensureMeshIP},
+	}
+	for _, step := range steps {
+		if err := retryWithBackoff(ctx, step.what, step.run); err != nil {
+			if ctx.Err() != nil {
+				log.Printf("Received signal during setup, exiting")
+				return
+			}
+			log.Fatalf("Error during setup: %v", err)
+		}
+	}
+	a.ensureKeyRotation(ctx)
 	fmt.Println("Completed setup.")
+	reportStatus := func() {
+		if err := a.updatePeerStatus(ctx); err != nil {
+			log.Printf("Error updating Peer status: %v", err)
+		}
+	}
+	reportStatus()
+
+	resync := time.NewTicker(resyncPeriod)
+	defer resync.Stop()
+	rotation := time.NewTicker(keyRotationCheckInterval)
+	defer rotation.Stop()
+	status := time.NewTicker(statusInterval)
+	defer status.Stop()
+	health := time.NewTicker(healthInterval)
+	defer health.Stop()
+
+	// a failed sync leaves the device as it was and is retried with backoff
+	backoff := newBackoff()
+	var retrySync <-chan time.Time
+	syncPeering := func() {
+		// the controller may assign a new mesh IP, such as when the Peer is
+		// recreated
+		if err := errors.Join(a.ensureMeshIP(ctx), a.ensurePeering(ctx)); err != nil {
+			delay := backoff.Step()
+			log.Printf("Error ensuring peering, retrying in %s: %v", delay.Round(time.Millisecond), err)
+			retrySync = time.After(delay)
+			return
+		}
+		backoff = newBackoff()
+		retrySync = nil
+		reportStatus()
+	}
+
+	// the Peer is updated when the node's pod addresses change, and the
+	// device and routes are synced with it
+	podAddrsBackoff := newBackoff()
+	var retryPodAddrs <-chan time.Time
+	syncPodAddrs := func() {
+		if err := a.ensurePodAddresses(ctx); err != nil {
+			delay := podAddrsBackoff.Step()
+			log.Printf("Error updating pod addresses, retrying in %s: %v", delay.Round(time.Millisecond), err)
+			retryPodAddrs = time.After(delay)
+			return
+		}
+		podAddrsBackoff = newBackoff()
+		retryPodAddrs = nil
+		syncPeering()
+	}
+
 	for {
 		select {
-		case sig := <-sigChan:
-			log.Printf("Received signal: %s. performing cleanup", sig)
-			cleanup()
+		case <-ctx.Done():
+			// the device and the Peer are kept so that a restart does not
+			// drop the tunnels or the mesh IP, the Peer is garbage
+			// collected with the node
+			log.Printf("Received signal, exiting")
 			return
-		default:
-			time.Sleep(2 * time.Second)
-			ensurePeeringWithGateways()
+		case <-a.meshChanged:
+			syncPeering()
+		case <-resync.C:
+			syncPeering()
+		case <-retrySync:
+			syncPeering()
+		case <-a.podAddrsChanged:
+			syncPodAddrs()
+		case <-retryPodAddrs:
+			syncPodAddrs()
+		case <-rotation.C:
+			a.ensureKeyRotation(ctx)
+		case <-status.C:
+			reportStatus()
+		case <-health.C:
+			failover, err := a.gatewayFailoverPending(ctx)
+			if err != nil {
+				log.Printf("Error checking gateway health: %v", err)
+			} else if failover {
+				syncPeering()
+			}
 		}
 	}
 }
 
-// this is all best effort so not blocking on any error
-func cleanup() {
-	// remove the wireguard interface
-	link, err := netlink.LinkByName(agentInfName)
+// podAddrConfig selects and configures the pod address source.
+type podAddrConfig struct {
+	source       string
+	static       []string
+	nncNamespace string
+}
+
+func newAgent(ctx context.Context, listenPort int, meshMode string, podAddrCfg podAddrConfig, rotator *keystore.Rotator) (*agent, error) {
+	nodeName := os.Getenv("NODE_NAME") // Use NODE_NAME environment variable
+	if nodeName == "" {
+		return nil, permanent(fmt.Errorf("NODE_NAME environment variable is not set"))
+	}
+
+	cfg, err := rest.InClusterConfig()
 	if err != nil {
-		log.Printf("could not get link %s: %v", agentInfName, err)
-	} else {
-		netlink.LinkDel(link)
+		return nil, permanent(fmt.Errorf("creating in-cluster config: %w", err))
 	}
-	// remove the peer resource
-	k8sClient, err := createK8sClient()
+	k8sClient, err := client.New(cfg, client.Options{Scheme: scheme})
 	if err != nil {
-		log.Printf("Error creating Kubernetes client: %v", err)
-		return
+		return nil, fmt.Errorf("creating Kubernetes client: %w", err)
 	}
-	err = k8sClient.Delete(context.Background(), &v1alpha1.Peer{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      os.Getenv("NODE_NAME"),
-			Namespace: metav1.NamespaceSystem,
-		},
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating Kubernetes clientset: %w", err)
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+
+	wg, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("creating WireGuard client: %w", err)
+	}
+
+	var podAddrs podaddrs.Source
+	switch podAddrCfg.source {
+	case podAddrSourceNode:
+		podAddrs = &podaddrs.NodeSource{Client: k8sClient}
+	case podAddrSourceStatic:
+		podAddrs = &podaddrs.StaticSource{Addresses: podAddrCfg.static}
+	default:
+		nncClient, err := acn.NewNncClient(cfg, podAddrCfg.nncNamespace)
+		if err != nil {
+			wg.Close()
+			return nil, err
+		}
+		podAddrs = &podaddrs.NNCSource{Client: nncClient}
+	}
+
+	a := &agent{
+		nodeName:        nodeName,
+		listenPort:      listenPort,
+		meshMode:        meshMode,
+		client:          k8sClient,
+		wg:              wg,
+		keys:            rotator.Current,
+		rotator:         rotator,
+		podAddrs:        podAddrs,
+		recorder:        broadcaster.NewRecorder(scheme, v1.EventSource{Component: "aks-mesh-agent", Host: nodeName}),
+		meshChanged:     make(chan struct{}, 1),
+		podAddrsChanged: make(chan struct{}, 1),
+		gatewayAdded:    make(map[wgtypes.Key]time.Time),
+	}
+	err = retryWithBackoff(ctx, "watch gateways", func(ctx context.Context) error {
+		return a.watchGateways(ctx, cfg)
 	})
+	if err == nil {
+		err = retryWithBackoff(ctx, "watch mesh IP", func(ctx context.Context) error {
+			return a.watchMeshIP(ctx, cfg)
+		})
+	}
+	if err == nil {
+		err = retryWithBackoff(ctx, "watch pod addresses", a.watchPodAddresses)
+	}
+	if err == nil && meshMode == meshModeFull {
+		err = retryWithBackoff(ctx, "watch peers", a.watchPeers)
+	}
 	if err != nil {
-		log.Printf("Error deleting Peer resource: %v", err)
+		wg.Close()
+		return nil, err
 	}
+	return a, nil
 }
 
-func ensureWireGuardInterface() {
+// this is all best effort so not blocking on any error
+func (a *agent) ensureWireGuardInterface(_ context.Context) error {
 	fmt.Println("Ensuring WireGuard interface...")
 
 	la := netlink.NewLinkAttrs()
@@ -109,316 +452,380 @@ func ensureWireGuardInterface() {
 
 	err := netlink.LinkAdd(wgLink)
 	if err != nil && !errors.Is(err, os.ErrExist) {
-		log.Fatalf("Error creating WireGuard interface: %v", err)
+		return fmt.Errorf("creating WireGuard interface: %w", err)
 	}
 
 	link, err := netlink.LinkByName(agentInfName)
 	if err != nil {
-		log.Fatalf("Error getting WireGuard interface: %v", err)
-	}
-
-	a := rand.Intn(31)
-	b := rand.Intn(254)
-	addr := &netlink.Addr{
-		IPNet: &net.IPNet{
-			IP:   net.ParseIP(fmt.Sprintf("100.255.%d.%d", a+224, b+1)),
-			Mask: net.CIDRMask(19, 32),
-		},
-	}
-
-	err = netlink.AddrAdd(link, addr)
-	if err != nil && !errors.Is(err, os.ErrExist) {
-		log.Fatalf("Error adding IP address to WireGuard interface: %v", err)
+		return fmt.Errorf("getting WireGuard interface: %w", err)
 	}
 
 	err = netlink.LinkSetUp(link)
 	if err != nil {
-		log.Fatalf("Error bringing up WireGuard interface: %v", err)
+		return fmt.Errorf("bringing up WireGuard interface: %w", err)
 	}
 
 	fmt.Println("WireGuard interface created and configured.")
+	return nil
 }
 
-func ensurePeeringWithGateways() {
-	fmt.Println("Ensuring peering with gateways...")
-
-	k8sClient, err := createK8sClient()
-	if err != nil {
-		log.Fatalf("Error creating Kubernetes client: %v", err)
-	}
-
-	var gatewayList v1alpha1.GatewayList
-	if err := k8sClient.List(context.Background(), &gatewayList); err != nil {
-		log.Fatalf("Error fetching Gateways: %v", err)
-	}
+func (a *agent) createPeerResource(ctx context.Context) error {
+	fmt.Println("Creating Peer resource...")
 
-	cli, err := wgctrl.New()
+	nodeIP, err := getNodeIP(ctx, a.client, a.nodeName, a.endpointIPv6)
 	if err != nil {
-		log.Fatalf("Error creating WireGuard client: %v", err)
+		return fmt.Errorf("getting node IP: %w", err)
 	}
-	defer cli.Close()
 
-	wgdev, err := cli.Device(agentInfName)
+	publicKey, err := a.getWireGuardPublicKey()
 	if err != nil {
-		log.Fatalf("Error getting WireGuard device: %v", err)
-	}
-
-	if wgdev.PrivateKey == [32]byte{} {
-		log.Default().Println("Generating new private key for WireGuard device...")
-		k, err := wgtypes.GeneratePrivateKey()
-		if err != nil {
-			log.Fatalf("Error generating private key: %v", err)
-		}
-
-		listPort := 51821
-		err = cli.ConfigureDevice(wgdev.Name, wgtypes.Config{
-			PrivateKey: &k,
-			ListenPort: &listPort,
-		})
-		if err != nil {
-			log.Fatalf("Error configuring WireGuard device: %v", err)
-		}
-	}
-
-	for _, gateway := range gatewayList.Items {
-		fmt.Printf("Configuring peering with gateway: %s (Endpoint: %s, PublicKey: %s)\n", gateway.Name, gateway.Spec.Endpoint, gateway.Spec.PublicKey)
-		cfg := wgtypes.PeerConfig{
-			PublicKey: mustParseKey(gateway.Spec.PublicKey),
-			Endpoint:  &net.UDPAddr{IP: net.ParseIP(gateway.Spec.Endpoint), Port: 51820},
-			AllowedIPs: []net.IPNet{
-				{
-					IP:   net.ParseIP("100.255.0.0"),
-					Mask: net.CIDRMask(16, 32),
-				},
-			},
-		}
-
-		err = cli.ConfigureDevice(wgdev.Name, wgtypes.Config{
-			Peers:        []wgtypes.PeerConfig{cfg},
-			ReplacePeers: false,
-		})
-		if err != nil {
-			log.Fatalf("Error configuring peering with gateway %s: %v", gateway.Name, err)
-		}
+		return fmt.Errorf("getting WireGuard public key: %w", err)
 	}
 
-	fmt.Println("Peering with gateways ensured.")
-}
-
-func createPeerResource() {
-	fmt.Println("Creating Peer resource...")
-
-	k8sClient, err := createK8sClient()
+	peer, err := a.buildPeer(ctx, nodeIP, publicKey)
 	if err != nil {
-		log.Fatalf("Error creating Kubernetes client: %v", err)
-	}
-	nodeName := os.Getenv("NODE_NAME") // Use NODE_NAME environment variable
-	if nodeName == "" {
-		log.Fatalf("NODE_NAME environment variable is not set")
-	}
-	nodeIP, err := getNodeIP(k8sClient, nodeName)
-	if err != nil {
-		log.Fatalf("Error getting node IP: %v", err)
+		return err
 	}
 
-	publicKey, err := getWireGuardPublicKey()
+	_, err = createOrUpdate(ctx, peer, a.client)
 	if err != nil {
-		log.Fatalf("Error getting WireGuard public key: %v", err)
+		return fmt.Errorf("creating Peer resource: %w", err)
 	}
 
-	cfg, err := rest.InClusterConfig()
-	if err != nil {
-		log.Fatalf("Error creating in-cluster config: %s", err)
-	}
+	fmt.Println("Peer resource created successfully.")
+	return nil
+}
 
-	nncCli := acn.NewNncClient(cfg)
-	nnc, err := nncCli.GetNnc(nodeName)
+// buildPeer returns the Peer advertising this node: its endpoint, public key
+// and pod addresses. The Peer is owned by the node.
+func (a *agent) buildPeer(ctx context.Context, nodeIP, publicKey string) (*v1alpha2.Peer, error) {
+	podAddrs, err := a.podAddrs.PodAddresses(ctx, a.nodeName)
 	if err != nil {
-		log.Fatalf("Error getting NodeNetworkConfig: %v", err)
+		return nil, fmt.Errorf("getting pod addresses: %w", err)
 	}
 
-	if len(nnc.Status.NetworkContainers) == 0 {
-		log.Fatalf("No network containers found in NodeNetworkConfig %v", nnc)
-	}
-
-	primaryIP := nnc.Status.NetworkContainers[0].PrimaryIP
-
-	peer := &v1alpha1.Peer{
+	peer := &v1alpha2.Peer{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      nodeName,
+			Name:      a.nodeName,
 			Namespace: metav1.NamespaceSystem,
 		},
-		Spec: v1alpha1.PeerSpec{
+		Spec: v1alpha2.PeerSpec{
+			ListenPort: a.listenPort,
 			PublicKey:  publicKey,
 			PodIPs:     []string{nodeIP},
 			Endpoint:   nodeIP,
-			AllowedIPs: []string{primaryIP},
-			MeshIP:     getWireGuardIP(),
+			AllowedIPs: podAddrs,
 		},
 	}
-
-	peer, err = createOrUpdate(peer, k8sClient)
-	if err != nil {
-		log.Fatalf("Error creating Peer resource: %v", err)
+	if a.nodeUID != "" {
+		peer.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "v1",
+			Kind:       "Node",
+			Name:       a.nodeName,
+			UID:        a.nodeUID,
+		}}
 	}
-
-	fmt.Println("Peer resource created successfully.")
+	return peer, nil
 }
 
-func createOrUpdate(p *v1alpha1.Peer, cli client.Client) (*v1alpha1.Peer, error) {
-	var curr v1alpha1.Peer
-	err := cli.Get(context.TODO(), client.ObjectKeyFromObject(p), &curr)
+// createOrUpdate creates the Peer p or updates the spec fields the agent
+// owns on the existing one. The next public key, written by key rotation, and
+// a requested mesh IP are kept, so a restart in a rotation window does not
+// withdraw the next key from the gateways.
+func createOrUpdate(ctx context.Context, p *v1alpha2.Peer, cli client.Client) (*v1alpha2.Peer, error) {
+	var curr v1alpha2.Peer
+	err := cli.Get(ctx, client.ObjectKeyFromObject(p), &curr)
 	if err != nil && !apierrors.IsNotFound(err) {
 		return nil, err
 	}
 
 	if apierrors.IsNotFound(err) {
 		// create
-		if err = cli.Create(context.TODO(), p); err != nil {
+		if err = cli.Create(ctx, p); err != nil {
 			return nil, err
 		}
 		return p, nil
 	}
 
 	// update
-	p.Spec.DeepCopyInto(&curr.Spec)
+	curr.Spec.ListenPort = p.Spec.ListenPort
+	curr.Spec.PublicKey = p.Spec.PublicKey
+	curr.Spec.Endpoint = p.Spec.Endpoint
+	curr.Spec.PodIPs = p.Spec.PodIPs
+	curr.Spec.AllowedIPs = p.Spec.AllowedIPs
+	if len(p.OwnerReferences) > 0 {
+		curr.OwnerReferences = p.OwnerReferences
+	}
 
-	if err = cli.Update(context.TODO(), &curr); err != nil {
+	if err = cli.Update(ctx, &curr); err != nil {
 		return nil, err
 	}
 	return &curr, nil
 }
 
-func getWireGuardIP() string {
-	// read the addr assigned to interface wga
-	link, err := netlink.LinkByName(agentInfName)
+// ensurePrivateKey configures the device with the persisted private key and
+// the listen port, so the Peer public key survives agent restarts and
+// interface re-creation. A key already on the device but not yet persisted is
+// adopted rather than replaced.
+func (a *agent) ensurePrivateKey(ctx context.Context) error {
+	fmt.Println("Ensuring WireGuard private key...")
+
+	wgdev, err := a.wg.Device(agentInfName)
 	if err != nil {
-		log.Fatalf("Error getting WireGuard interface: %v", err)
+		return fmt.Errorf("getting WireGuard device: %w", err)
+	}
+
+	var key wgtypes.Key
+	_, loadErr := a.keys.Load(ctx)
+	switch {
+	case errors.Is(loadErr, keystore.ErrNotFound) && wgdev.PrivateKey != (wgtypes.Key{}):
+		log.Default().Println("Persisting existing private key of WireGuard device...")
+		key = wgdev.PrivateKey
+		err = a.keys.Save(ctx, key)
+	default:
+		var created bool
+		key, created, err = keystore.LoadOrCreate(ctx, a.keys)
+		if created {
+			log.Default().Println("Generated new private key for WireGuard device...")
+		}
 	}
-	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
 	if err != nil {
-		log.Fatalf("Error getting WireGuard interface addresses: %v", err)
+		return fmt.Errorf("loading private key: %w", err)
 	}
-	if len(addrs) == 0 {
-		log.Fatalf("WireGuard interface has no addresses")
+
+	if wgdev.PrivateKey == key && wgdev.ListenPort == a.listenPort {
+		return nil
 	}
-	return addrs[0].IP.String()
+	err = a.wg.ConfigureDevice(wgdev.Name, wgtypes.Config{
+		PrivateKey: &key,
+		ListenPort: &a.listenPort,
+	})
+	if err != nil {
+		return fmt.Errorf("configuring WireGuard device: %w", err)
+	}
+	return nil
 }
 
-func createK8sClient() (client.Client, error) {
-	config, err := rest.InClusterConfig()
+// ensureKeyRotation advances scheduled key rotation, switches the device to
+// a rotated key and publishes the current and next public keys in the Peer
+// spec, and the key fingerprint and rotation time in its status.
+func (a *agent) ensureKeyRotation(ctx context.Context) {
+	state, err := a.rotator.Step(ctx, time.Now())
 	if err != nil {
-		return nil, err
+		log.Printf("Error rotating private key: %v", err)
+		return
 	}
-	return client.New(config, client.Options{Scheme: scheme})
-}
 
-func getNodeIP(k8sClient client.Client, nodeName string) (string, error) {
-	node := &v1.Node{}
-	err := k8sClient.Get(context.Background(), client.ObjectKey{Name: nodeName}, node)
+	wgdev, err := a.wg.Device(agentInfName)
 	if err != nil {
-		return "", err
+		log.Printf("Error getting WireGuard device: %v", err)
+		return
 	}
-	for _, addr := range node.Status.Addresses {
-		if addr.Type == v1.NodeInternalIP {
-			return addr.Address, nil
+	if wgdev.PrivateKey != state.Current {
+		log.Printf("Switching WireGuard device to rotated key %s", state.Current.PublicKey())
+		err = a.wg.ConfigureDevice(wgdev.Name, wgtypes.Config{PrivateKey: &state.Current})
+		if err != nil {
+			log.Printf("Error configuring rotated private key: %v", err)
+			return
 		}
 	}
-	return "", fmt.Errorf("node internal IP not found")
-}
 
-func getWireGuardPublicKey() (string, error) {
-	wgc, err := wgctrl.New()
-	if err != nil {
-		return "", err
+	publicKey := state.Current.PublicKey().String()
+	nextPublicKey := ""
+	if state.Next != nil {
+		nextPublicKey = state.Next.PublicKey().String()
 	}
-	defer wgc.Close()
+	fingerprint := keystore.Fingerprint(state.Current.PublicKey())
+	rotatedAt := metav1.NewTime(state.RotatedAt.Truncate(time.Second))
 
-	dev, err := wgc.Device(agentInfName)
+	key := client.ObjectKey{Name: a.nodeName, Namespace: metav1.NamespaceSystem}
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var peer v1alpha2.Peer
+		if err := a.client.Get(ctx, key, &peer); err != nil {
+			return err
+		}
+		if peer.Spec.PublicKey != publicKey || peer.Spec.NextPublicKey != nextPublicKey {
+			peer.Spec.PublicKey = publicKey
+			peer.Spec.NextPublicKey = nextPublicKey
+			if err := a.client.Update(ctx, &peer); err != nil {
+				return err
+			}
+		}
+		if peer.Status.PublicKeyFingerprint == fingerprint && rotatedAt.Equal(peer.Status.LastKeyRotationTime) {
+			return nil
+		}
+		peer.Status.PublicKeyFingerprint = fingerprint
+		peer.Status.LastKeyRotationTime = &rotatedAt
+		return a.client.Status().Update(ctx, &peer)
+	})
 	if err != nil {
-		return "", err
+		log.Printf("Error publishing keys in Peer resource: %v", err)
 	}
-	return dev.PublicKey.String(), nil
 }
 
-func createConfigMap(k8sClient kubernetes.Interface, publicKey string) error {
-	configMap := &v1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "wg-publickey-config",
-			Namespace: "kube-system",
-		},
-		Data: map[string]string{
-			"publickey": publicKey,
+// watchMeshIP starts an informer on this node's Peer and waits for its cache
+// to sync. Every change of the mesh addresses the controller assigned to it
+// signals meshChanged, so that the sync applies them.
+func (a *agent) watchMeshIP(ctx context.Context, cfg *rest.Config) error {
+	c, err := cache.New(cfg, cache.Options{
+		Scheme:            scheme,
+		DefaultNamespaces: map[string]cache.Config{metav1.NamespaceSystem: {}},
+		ByObject: map[client.Object]cache.ByObject{
+			&v1alpha2.Peer{}: {Field: fields.OneTermEqualSelector("metadata.name", a.nodeName)},
 		},
+	})
+	if err != nil {
+		return fmt.Errorf("creating Peer cache: %w", err)
 	}
-	_, err := k8sClient.CoreV1().ConfigMaps("kube-system").Create(context.TODO(), configMap, metav1.CreateOptions{})
+	informer, err := c.GetInformer(ctx, &v1alpha2.Peer{})
 	if err != nil {
-		if apierrors.IsAlreadyExists(err) {
-			fmt.Println("ConfigMap already exists.")
-			return nil
+		return fmt.Errorf("creating Peer informer: %w", err)
+	}
+	_, err = informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { a.notifyMeshChanged() },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPeer, ok1 := oldObj.(*v1alpha2.Peer)
+			newPeer, ok2 := newObj.(*v1alpha2.Peer)
+			if ok1 && ok2 && oldPeer.Status.MeshIP == newPeer.Status.MeshIP && oldPeer.Status.MeshSubnet == newPeer.Status.MeshSubnet &&
+				slices.Equal(oldPeer.Status.MeshIPs, newPeer.Status.MeshIPs) && slices.Equal(oldPeer.Status.MeshSubnets, newPeer.Status.MeshSubnets) {
+				return
+			}
+			a.notifyMeshChanged()
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("registering Peer event handler: %w", err)
+	}
+
+	go func() {
+		if err := c.Start(ctx); err != nil {
+			log.Printf("Peer cache stopped: %v", err)
 		}
-		return err
+	}()
+	if !c.WaitForCacheSync(ctx) {
+		return fmt.Errorf("Peer cache did not sync")
 	}
 	return nil
 }
 
-func updateConfigMapWithPublicKey(clientset *kubernetes.Clientset, publicKey string) error {
-	cm, err := clientset.CoreV1().ConfigMaps("kube-system").Get(context.Background(), "wg-publickey-config", metav1.GetOptions{})
+// ensureMeshIP configures the mesh addresses the controller assigned to this
+// node's Peer on the WireGuard interface, replacing any other address left
+// behind on the interface. It fails with errMeshIPPending until an address
+// has been assigned.
+func (a *agent) ensureMeshIP(ctx context.Context) error {
+	var peer v1alpha2.Peer
+	key := client.ObjectKey{Name: a.nodeName, Namespace: metav1.NamespaceSystem}
+	if err := a.client.Get(ctx, key, &peer); err != nil {
+		return fmt.Errorf("getting Peer resource: %w", err)
+	}
+	if peer.Status.MeshIP == "" || peer.Status.MeshSubnet == "" {
+		return errMeshIPPending
+	}
+	meshIPs, err := meshaddr.Addrs(peer.Status.MeshIP, peer.Status.MeshSubnet, peer.Status.MeshIPs, peer.Status.MeshSubnets)
 	if err != nil {
 		return err
 	}
+	want := make([]netlink.Addr, 0, len(meshIPs))
+	for i := range meshIPs {
+		want = append(want, netlink.Addr{IPNet: &meshIPs[i]})
+	}
 
-	nodeName, err := os.Hostname()
+	link, err := netlink.LinkByName(agentInfName)
 	if err != nil {
-		return err
+		return fmt.Errorf("getting WireGuard interface: %w", err)
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("getting WireGuard interface addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() || slices.ContainsFunc(want, addr.Equal) {
+			continue
+		}
+		if err := netlink.AddrDel(link, &addr); err != nil {
+			log.Printf("Error removing stale address %s: %v", addr.IPNet, err)
+		}
 	}
 
-	if cm.Data == nil {
-		cm.Data = make(map[string]string)
+	for i := range want {
+		err = netlink.AddrAdd(link, &want[i])
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("adding IP address %s to WireGuard interface: %w", want[i].IPNet, err)
+		}
+		fmt.Printf("Mesh IP %s configured.\n", want[i].IPNet)
 	}
-	cm.Data[nodeName] = publicKey
 
-	_, err = clientset.CoreV1().ConfigMaps("kube-system").Update(context.Background(), cm, metav1.UpdateOptions{})
-	return err
+	// the mesh networks are routed through the active gateway, which takes a
+	// sync once they are known or change
+	routes := make([]net.IPNet, 0, len(meshIPs))
+	for _, meshIP := range meshIPs {
+		routes = append(routes, net.IPNet{IP: meshIP.IP.Mask(meshIP.Mask), Mask: meshIP.Mask})
+	}
+	if !slices.EqualFunc(routes, a.meshRoutes, func(x, y net.IPNet) bool { return x.String() == y.String() }) {
+		a.meshRoutes = routes
+		a.notifyMeshChanged()
+	}
+	return nil
 }
 
-func getWireGuardKeyPair() (wgtypes.Key, wgtypes.Key, error) {
-	privateKey, err := wgtypes.GeneratePrivateKey()
-	if err != nil {
-		return wgtypes.Key{}, wgtypes.Key{}, err
+// ensureTopology reads the zone and region of the node from its topology
+// labels, and the node's UID.
+func (a *agent) ensureTopology(ctx context.Context) error {
+	node := &v1.Node{}
+	if err := a.client.Get(ctx, client.ObjectKey{Name: a.nodeName}, node); err != nil {
+		return fmt.Errorf("getting node: %w", err)
 	}
-	publicKey := privateKey.PublicKey()
-	return privateKey, publicKey, nil
+	a.zone = node.Labels[v1.LabelTopologyZone]
+	a.region = node.Labels[v1.LabelTopologyRegion]
+	a.nodeUID = node.UID
+	fmt.Printf("Node topology: zone %q, region %q\n", a.zone, a.region)
+	return nil
 }
 
-func getWireGuardKeys() (wgtypes.Key, string, error) {
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		return wgtypes.Key{}, "", err
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
+}
 
-	k8sClient, err := kubernetes.NewForConfig(config)
+// getNodeIP returns the first internal IP of the node in the preferred IP
+// family, or its first internal IP if it has none in that family.
+func getNodeIP(ctx context.Context, k8sClient client.Client, nodeName string, ipv6 bool) (string, error) {
+	node := &v1.Node{}
+	err := k8sClient.Get(ctx, client.ObjectKey{Name: nodeName}, node)
 	if err != nil {
-		return wgtypes.Key{}, "", err
+		return "", err
 	}
-
-	_, publicKey, err := getWireGuardKeyPair()
-	if err != nil {
-		return wgtypes.Key{}, "", err
+	first := ""
+	for _, addr := range node.Status.Addresses {
+		if addr.Type != v1.NodeInternalIP {
+			continue
+		}
+		if first == "" {
+			first = addr.Address
+		}
+		if ip := net.ParseIP(addr.Address); ip != nil && (ip.To4() == nil) == ipv6 {
+			return addr.Address, nil
+		}
 	}
-
-	err = createConfigMap(k8sClient, publicKey.String())
-	if err != nil {
-		return wgtypes.Key{}, "", err
+	if first == "" {
+		return "", errNodeIPPending
 	}
-
-	return wgtypes.Key{}, publicKey.String(), nil
+	return first, nil
 }
 
-func mustParseKey(s string) wgtypes.Key {
-	k, err := wgtypes.ParseKey(s)
+func (a *agent) getWireGuardPublicKey() (string, error) {
+	dev, err := a.wg.Device(agentInfName)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	return k
+	return dev.PublicKey.String(), nil
 }
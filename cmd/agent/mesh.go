@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/meshaddr"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/podroutes"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+const (
+	// meshModeHub peers agents with gateways only, node to node traffic
+	// through the mesh goes via a gateway.
+	meshModeHub = "hub"
+	// meshModeFull additionally peers every agent with every other Peer, so
+	// pod traffic between nodes takes the direct tunnel.
+	meshModeFull = "full"
+)
+
+// watchPeers starts an informer on Peer objects in the cache that already
+// holds the Gateways. Every add, spec, mesh IP or validity change and delete
+// signals meshChanged.
+func (a *agent) watchPeers(ctx context.Context) error {
+	informer, err := a.informers.GetInformer(ctx, &v1alpha2.Peer{})
+	if err != nil {
+		return fmt.Errorf("creating peer informer: %w", err)
+	}
+	_, err = informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { a.notifyMeshChanged() },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPeer, ok1 := oldObj.(*v1alpha2.Peer)
+			newPeer, ok2 := newObj.(*v1alpha2.Peer)
+			// status updates other than the mesh IP and validity, such as
+			// tunnel counters, do not affect the device
+			if ok1 && ok2 && oldPeer.Generation == newPeer.Generation &&
+				oldPeer.Status.MeshIP == newPeer.Status.MeshIP && slices.Equal(oldPeer.Status.MeshIPs, newPeer.Status.MeshIPs) &&
+				peerInvalid(oldPeer) == peerInvalid(newPeer) {
+				return
+			}
+			a.notifyMeshChanged()
+		},
+		DeleteFunc: func(obj interface{}) { a.notifyMeshChanged() },
+	})
+	if err != nil {
+		return fmt.Errorf("registering peer event handler: %w", err)
+	}
+	return nil
+}
+
+// meshPeers returns the device peers for every other node in full mesh mode,
+// and the pod networks that must be routed into the device to reach them.
+// Peers with an invalid key, endpoint or allowed IP are skipped and reported.
+// Peers the controller found invalid, such as one whose allowed IPs overlap
+// those of an older Peer, are skipped as well, so they cannot take over the
+// older Peer's addresses.
+func (a *agent) meshPeers(ctx context.Context) ([]wgtypes.PeerConfig, []net.IPNet, error) {
+	if a.meshMode != meshModeFull {
+		return nil, nil, nil
+	}
+
+	var peerList v1alpha2.PeerList
+	if err := a.informers.List(ctx, &peerList); err != nil {
+		return nil, nil, fmt.Errorf("fetching Peers: %w", err)
+	}
+	var configs []wgtypes.PeerConfig
+	var routes []net.IPNet
+	for i := range peerList.Items {
+		peer := &peerList.Items[i]
+		if peer.Name == a.nodeName || peerInvalid(peer) {
+			continue
+		}
+		peerConfigs, podNets, err := meshPeerConfigs(peer)
+		if err != nil {
+			log.Printf("Skipping peer %s: %v", peer.Name, err)
+			a.recorder.Eventf(peer, v1.EventTypeWarning, "InvalidPeer",
+				"Agent on node %s skipped peer: %v", a.nodeName, err)
+			continue
+		}
+		configs = append(configs, peerConfigs...)
+		routes = append(routes, podNets...)
+	}
+	return configs, routes, nil
+}
+
+// peerInvalid reports whether the controller set the Peer's Valid condition
+// to false.
+func peerInvalid(peer *v1alpha2.Peer) bool {
+	return meta.IsStatusConditionFalse(peer.Status.Conditions, v1alpha2.PeerValid)
+}
+
+// meshPeerConfigs returns the device peers for another node's Peer and its
+// pod networks. The first peer routes the node's mesh IPs and pod networks, a
+// next key is accepted ahead of its rotation but not routed.
+func meshPeerConfigs(peer *v1alpha2.Peer) ([]wgtypes.PeerConfig, []net.IPNet, error) {
+	publicKey, err := wgtypes.ParseKey(peer.Spec.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid public key %q: %w", peer.Spec.PublicKey, err)
+	}
+	ip := net.ParseIP(peer.Spec.Endpoint)
+	if ip == nil {
+		return nil, nil, fmt.Errorf("invalid endpoint %q", peer.Spec.Endpoint)
+	}
+	port := peer.Spec.ListenPort
+	if port == 0 {
+		port = defaultListenPort
+	}
+
+	var podNets []net.IPNet
+	for _, allowedIP := range peer.Spec.AllowedIPs {
+		ipNet, err := meshaddr.ParseIPOrCIDR(allowedIP)
+		if err != nil {
+			return nil, nil, err
+		}
+		podNets = append(podNets, ipNet)
+	}
+	cfg := wgtypes.PeerConfig{
+		PublicKey:         publicKey,
+		Endpoint:          &net.UDPAddr{IP: ip, Port: port},
+		ReplaceAllowedIPs: true,
+		AllowedIPs:        append([]net.IPNet(nil), podNets...),
+	}
+	// the mesh IPs are routed by the interface's own subnet routes
+	meshIPs, err := meshaddr.Addrs(peer.Status.MeshIP, "", peer.Status.MeshIPs, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, meshIP := range meshIPs {
+		cfg.AllowedIPs = append(cfg.AllowedIPs, meshaddr.HostNet(meshIP.IP))
+	}
+	if peer.Spec.NextPublicKey == "" {
+		return []wgtypes.PeerConfig{cfg}, podNets, nil
+	}
+
+	nextKey, err := wgtypes.ParseKey(peer.Spec.NextPublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid next public key %q: %w", peer.Spec.NextPublicKey, err)
+	}
+	next := wgtypes.PeerConfig{
+		PublicKey:         nextKey,
+		Endpoint:          cfg.Endpoint,
+		ReplaceAllowedIPs: true,
+	}
+	return []wgtypes.PeerConfig{cfg, next}, podNets, nil
+}
+
+// ensurePodRoutes routes dsts into the WireGuard interface and removes the
+// routes to pod networks of nodes that left the mesh. With no dsts, as in hub
+// mode, all routes the agent programmed are removed.
+func ensurePodRoutes(dsts []net.IPNet) error {
+	link, err := netlink.LinkByName(agentInfName)
+	if err != nil {
+		return fmt.Errorf("getting WireGuard interface: %w", err)
+	}
+	return podroutes.Ensure(link, dsts)
+}
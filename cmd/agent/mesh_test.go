@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// fakeCache serves List from a fake client.
+type fakeCache struct {
+	cache.Cache
+	client client.Client
+}
+
+func (c *fakeCache) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return c.client.List(ctx, list, opts...)
+}
+
+func TestMeshPeersSkipsInvalidPeers(t *testing.T) {
+	newPeer := func(name, allowedIP string, valid metav1.ConditionStatus) (*v1alpha2.Peer, wgtypes.Key) {
+		key := testKey(t)
+		return &v1alpha2.Peer{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: metav1.NamespaceSystem},
+			Spec:       v1alpha2.PeerSpec{PublicKey: key.String(), Endpoint: "10.224.0.5", AllowedIPs: []string{allowedIP}},
+			Status: v1alpha2.PeerStatus{
+				MeshIP:     "100.255.224.5",
+				Conditions: []metav1.Condition{{Type: v1alpha2.PeerValid, Status: valid, Reason: "Conflict"}},
+			},
+		}, key
+	}
+	older, olderKey := newPeer("node-2", "10.241.0.0/24", metav1.ConditionTrue)
+	// the newer Peer overlaps the older one's allowed IPs
+	newer, _ := newPeer("node-3", "10.241.0.0/25", metav1.ConditionFalse)
+
+	a := &agent{
+		nodeName: "node-1",
+		meshMode: meshModeFull,
+		informers: &fakeCache{
+			client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(older, newer).Build(),
+		},
+		recorder: record.NewFakeRecorder(10),
+	}
+	configs, routes, err := a.meshPeers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 1 || configs[0].PublicKey != olderKey {
+		t.Errorf("expected only the older Peer to be configured, got %+v", configs)
+	}
+	if len(routes) != 1 || routes[0].String() != "10.241.0.0/24" {
+		t.Errorf("expected only the older Peer's pod network to be routed, got %v", routes)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	acnv1alpha "github.com/Azure/azure-container-networking/crd/nodenetworkconfig/api/v1alpha"
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	acnfake "github.com/t-chdossa_microsoft/aks-mesh/pkg/acn/fake"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/podaddrs"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func testNnc(nodeName string, ncs ...acnv1alpha.NetworkContainer) *acnv1alpha.NodeNetworkConfig {
+	return &acnv1alpha.NodeNetworkConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeName, Namespace: metav1.NamespaceSystem},
+		Status:     acnv1alpha.NodeNetworkConfigStatus{NetworkContainers: ncs},
+	}
+}
+
+func TestBuildPeer(t *testing.T) {
+	ctx := context.Background()
+	nncs := acnfake.NewNncGetter(testNnc("node-1",
+		acnv1alpha.NetworkContainer{
+			ID:            "nc-1",
+			PrimaryIP:     "10.241.0.4",
+			IPAssignments: []acnv1alpha.IPAssignment{{Name: "a", IP: "10.241.0.5"}},
+		},
+		acnv1alpha.NetworkContainer{ID: "nc-2", PrimaryIP: "10.242.0.0/28"},
+	))
+	a := &agent{
+		nodeName:   "node-1",
+		nodeUID:    "node-1-uid",
+		listenPort: defaultListenPort,
+		podAddrs:   &podaddrs.NNCSource{Client: nncs},
+	}
+
+	peer, err := a.buildPeer(ctx, "10.224.0.5", "public-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Name != "node-1" || peer.Namespace != metav1.NamespaceSystem {
+		t.Fatalf("unexpected Peer %s/%s", peer.Namespace, peer.Name)
+	}
+	// the Peer outlives agent restarts and is garbage collected with the node
+	if len(peer.OwnerReferences) != 1 || peer.OwnerReferences[0].Kind != "Node" || peer.OwnerReferences[0].UID != "node-1-uid" {
+		t.Fatalf("expected the Peer to be owned by its node, got %+v", peer.OwnerReferences)
+	}
+	want := v1alpha2.PeerSpec{
+		ListenPort: defaultListenPort,
+		PublicKey:  "public-key",
+		PodIPs:     []string{"10.224.0.5"},
+		Endpoint:   "10.224.0.5",
+		AllowedIPs: []string{"10.241.0.4/32", "10.241.0.5/32", "10.242.0.0/28"},
+	}
+	if !equalSpec(peer.Spec, want) {
+		t.Fatalf("expected spec %+v, got %+v", want, peer.Spec)
+	}
+}
+
+func TestBuildPeerWithoutNetworkContainers(t *testing.T) {
+	ctx := context.Background()
+	nncs := acnfake.NewNncGetter(testNnc("node-1"))
+	a := &agent{nodeName: "node-1", podAddrs: &podaddrs.NNCSource{Client: nncs}}
+
+	if _, err := a.buildPeer(ctx, "10.224.0.5", "public-key"); !errors.Is(err, podaddrs.ErrNotAssigned) {
+		t.Fatalf("expected ErrNotAssigned, got %v", err)
+	}
+
+	a.nodeName = "node-2"
+	if _, err := a.buildPeer(ctx, "10.224.0.6", "public-key"); err == nil || errors.Is(err, podaddrs.ErrNotAssigned) {
+		t.Fatalf("expected a lookup error for a node without NodeNetworkConfig, got %v", err)
+	}
+}
+
+func TestEnsurePodAddressesFollowsNnc(t *testing.T) {
+	ctx := context.Background()
+	nncs := acnfake.NewNncGetter(testNnc("node-1", acnv1alpha.NetworkContainer{ID: "nc-1", PrimaryIP: "10.241.0.4"}))
+	a := &agent{
+		nodeName:        "node-1",
+		podAddrs:        &podaddrs.NNCSource{Client: nncs},
+		podAddrsChanged: make(chan struct{}, 1),
+	}
+	peer, err := a.buildPeer(ctx, "10.224.0.5", "public-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.client = fake.NewClientBuilder().WithScheme(scheme).WithObjects(peer).Build()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := a.watchPodAddresses(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-a.podAddrsChanged
+
+	// the network container is reassigned
+	nncs.Set(testNnc("node-1", acnv1alpha.NetworkContainer{ID: "nc-2", PrimaryIP: "10.241.1.7"}))
+	select {
+	case <-a.podAddrsChanged:
+	default:
+		t.Fatal("expected a pod address change to be signalled")
+	}
+	if err := a.ensurePodAddresses(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var updated v1alpha2.Peer
+	if err := a.client.Get(ctx, client.ObjectKeyFromObject(peer), &updated); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(updated.Spec.AllowedIPs, []string{"10.241.1.7/32"}) {
+		t.Fatalf("expected the Peer to advertise the new address, got %v", updated.Spec.AllowedIPs)
+	}
+	if updated.Spec.PublicKey != "public-key" || updated.Spec.Endpoint != "10.224.0.5" {
+		t.Fatalf("expected the rest of the spec to be kept, got %+v", updated.Spec)
+	}
+}
+
+func TestCreateOrUpdateKeepsNextPublicKey(t *testing.T) {
+	ctx := context.Background()
+	existing := &v1alpha2.Peer{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Namespace: metav1.NamespaceSystem},
+		Spec: v1alpha2.PeerSpec{
+			PublicKey:     "public-key",
+			NextPublicKey: "next-public-key",
+			MeshIP:        "100.255.224.9",
+			Endpoint:      "10.224.0.5",
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(existing).Build()
+
+	// the restarted agent builds the Peer without the pending next key
+	built := &v1alpha2.Peer{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Namespace: metav1.NamespaceSystem},
+		Spec: v1alpha2.PeerSpec{
+			ListenPort: defaultListenPort,
+			PublicKey:  "public-key",
+			PodIPs:     []string{"10.224.0.6"},
+			Endpoint:   "10.224.0.6",
+			AllowedIPs: []string{"10.241.0.4/32"},
+		},
+	}
+	if _, err := createOrUpdate(ctx, built, c); err != nil {
+		t.Fatal(err)
+	}
+
+	var updated v1alpha2.Peer
+	if err := c.Get(ctx, client.ObjectKeyFromObject(existing), &updated); err != nil {
+		t.Fatal(err)
+	}
+	want := built.Spec
+	want.NextPublicKey = "next-public-key"
+	want.MeshIP = "100.255.224.9"
+	if !equalSpec(updated.Spec, want) {
+		t.Fatalf("expected spec %+v, got %+v", want, updated.Spec)
+	}
+}
+
+func equalSpec(a, b v1alpha2.PeerSpec) bool {
+	return a.ListenPort == b.ListenPort && a.PublicKey == b.PublicKey && a.Endpoint == b.Endpoint &&
+		slices.Equal(a.PodIPs, b.PodIPs) && slices.Equal(a.AllowedIPs, b.AllowedIPs) &&
+		a.MeshIP == b.MeshIP && a.NextPublicKey == b.NextPublicKey
+}
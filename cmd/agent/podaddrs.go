@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/podaddrs"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// watchPodAddresses signals podAddrsChanged whenever the pod address source
+// reports a change. Sources whose addresses cannot change are not watched.
+func (a *agent) watchPodAddresses(ctx context.Context) error {
+	watcher, ok := a.podAddrs.(podaddrs.Watcher)
+	if !ok {
+		return nil
+	}
+	return watcher.Watch(ctx, a.nodeName, func() {
+		select {
+		case a.podAddrsChanged <- struct{}{}:
+		default:
+			// a refresh is already pending
+		}
+	})
+}
+
+// ensurePodAddresses publishes the current pod addresses of the node as the
+// Peer's allowed IPs, so gateways and other nodes route the node's new
+// addresses to it.
+func (a *agent) ensurePodAddresses(ctx context.Context) error {
+	podAddrs, err := a.podAddrs.PodAddresses(ctx, a.nodeName)
+	if err != nil {
+		return fmt.Errorf("getting pod addresses: %w", err)
+	}
+
+	key := client.ObjectKey{Name: a.nodeName, Namespace: metav1.NamespaceSystem}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var peer v1alpha2.Peer
+		if err := a.client.Get(ctx, key, &peer); err != nil {
+			return err
+		}
+		if slices.Equal(peer.Spec.AllowedIPs, podAddrs) {
+			return nil
+		}
+		log.Printf("Pod addresses changed from %v to %v", peer.Spec.AllowedIPs, podAddrs)
+		peer.Spec.AllowedIPs = podAddrs
+		return a.client.Update(ctx, &peer)
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/podaddrs"
+	"github.com/vishvananda/netlink"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// permanentError marks an error that retrying cannot fix, such as missing
+// configuration or a request the API server rejected as invalid.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// permanent marks err as not worth retrying.
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// isTransient reports whether err is likely to go away on its own: an API
+// server blip, a network, netlink or wgctrl hiccup, or a step waiting for the
+// controller or Azure CNI to assign addresses. API errors are transient only
+// if the server says so. Anything else, such as a key or CIDR that does not
+// parse, fails fast, as do errors explicitly marked permanent.
+func isTransient(err error) bool {
+	var perm *permanentError
+	if errors.As(err, &perm) {
+		return false
+	}
+	if errors.Is(err, errMeshIPPending) || errors.Is(err, errNodeIPPending) || errors.Is(err, podaddrs.ErrNotAssigned) {
+		return true
+	}
+
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		return apierrors.IsServerTimeout(err) ||
+			apierrors.IsTimeout(err) ||
+			apierrors.IsTooManyRequests(err) ||
+			apierrors.IsServiceUnavailable(err) ||
+			apierrors.IsInternalError(err) ||
+			apierrors.IsUnexpectedServerError(err) ||
+			apierrors.IsConflict(err) ||
+			apierrors.IsNotFound(err)
+	}
+
+	// address parse errors implement net.Error too
+	var parseErr *net.ParseError
+	var addrErr *net.AddrError
+	if errors.As(err, &parseErr) || errors.As(err, &addrErr) {
+		return false
+	}
+	var netErr net.Error
+	var errno syscall.Errno
+	var linkNotFound netlink.LinkNotFoundError
+	return errors.As(err, &netErr) ||
+		errors.As(err, &errno) ||
+		errors.As(err, &linkNotFound) ||
+		errors.Is(err, os.ErrNotExist) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// newBackoff returns the exponential backoff used between retries. Once the
+// steps are used up every further retry waits Cap.
+func newBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: time.Second,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    10,
+		Cap:      2 * time.Minute,
+	}
+}
+
+// retryWithBackoff runs fn until it succeeds, returns a non transient error or ctx is
+// done, backing off exponentially between attempts.
+func retryWithBackoff(ctx context.Context, what string, fn func(context.Context) error) error {
+	backoff := newBackoff()
+	for {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if !isTransient(err) {
+			return fmt.Errorf("%s: %w", what, err)
+		}
+
+		delay := backoff.Step()
+		log.Printf("Error trying to %s, retrying in %s: %v", what, delay.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", what, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
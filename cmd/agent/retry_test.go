@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/podaddrs"
+	"github.com/vishvananda/netlink"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestIsTransient(t *testing.T) {
+	peers := schema.GroupResource{Group: "aks.azure.com", Resource: "peers"}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "netlink error", err: syscall.EBUSY, want: true},
+		{name: "wrapped network error", err: fmt.Errorf("getting Peer: %w", syscall.ECONNREFUSED), want: true},
+		{name: "server timeout", err: apierrors.NewServerTimeout(peers, "get", 1), want: true},
+		{name: "timeout", err: apierrors.NewTimeoutError("slow", 1), want: true},
+		{name: "too many requests", err: apierrors.NewTooManyRequests("slow down", 1), want: true},
+		{name: "service unavailable", err: apierrors.NewServiceUnavailable("down"), want: true},
+		{name: "internal error", err: apierrors.NewInternalError(errors.New("boom")), want: true},
+		{name: "conflict", err: apierrors.NewConflict(peers, "node-1", errors.New("modified")), want: true},
+		{name: "not found", err: apierrors.NewNotFound(peers, "node-1"), want: true},
+		{name: "wrapped conflict", err: fmt.Errorf("updating Peer: %w", apierrors.NewConflict(peers, "node-1", errors.New("modified"))), want: true},
+		{name: "invalid", err: apierrors.NewInvalid(schema.GroupKind{Group: "aks.azure.com", Kind: "Peer"}, "node-1", nil), want: false},
+		{name: "bad request", err: apierrors.NewBadRequest("bad"), want: false},
+		{name: "forbidden", err: apierrors.NewForbidden(peers, "node-1", errors.New("denied")), want: false},
+		{name: "unauthorized", err: apierrors.NewUnauthorized("who"), want: false},
+		{name: "already exists", err: apierrors.NewAlreadyExists(peers, "node-1"), want: false},
+		{name: "link not found", err: fmt.Errorf("getting WireGuard interface: %w", netlink.LinkNotFoundError{}), want: true},
+		{name: "device not found", err: fmt.Errorf("getting WireGuard device: %w", os.ErrNotExist), want: true},
+		{name: "dial error", err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, want: true},
+		{name: "connection reset", err: fmt.Errorf("watch: %w", io.ErrUnexpectedEOF), want: true},
+		{name: "client timeout", err: fmt.Errorf("listing Gateways: %w", context.DeadlineExceeded), want: true},
+		{name: "mesh IP pending", err: errMeshIPPending, want: true},
+		{name: "node IP pending", err: fmt.Errorf("getting node IP: %w", errNodeIPPending), want: true},
+		{name: "pod addresses not assigned", err: fmt.Errorf("getting pod addresses: %w", podaddrs.ErrNotAssigned), want: true},
+		{name: "invalid key", err: fmt.Errorf("parsing private key: %w", errors.New("wgtypes: incorrect key size: 3")), want: false},
+		{name: "invalid CIDR", err: &net.ParseError{Type: "CIDR address", Text: "10.0.0.0/33"}, want: false},
+		{name: "invalid address", err: fmt.Errorf("endpoint: %w", &net.AddrError{Err: "missing port in address", Addr: "10.0.0.1"}), want: false},
+		{name: "invalid flag value", err: errors.New(`invalid shard key "x"`), want: false},
+		{name: "marked permanent", err: permanent(errors.New("missing flag")), want: false},
+		{name: "wrapped permanent", err: fmt.Errorf("setup: %w", permanent(syscall.EBUSY)), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransient(tt.err); got != tt.want {
+				t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	t.Run("retries transient errors", func(t *testing.T) {
+		attempts := 0
+		err := retryWithBackoff(context.Background(), "test", func(context.Context) error {
+			attempts++
+			if attempts == 1 {
+				return syscall.EBUSY
+			}
+			return nil
+		})
+		if err != nil || attempts != 2 {
+			t.Errorf("got %v after %d attempts, want success after 2", err, attempts)
+		}
+	})
+
+	t.Run("stops at a permanent error", func(t *testing.T) {
+		attempts := 0
+		err := retryWithBackoff(context.Background(), "test", func(context.Context) error {
+			attempts++
+			return apierrors.NewBadRequest("bad")
+		})
+		if !apierrors.IsBadRequest(err) || attempts != 1 {
+			t.Errorf("got %v after %d attempts, want the bad request after 1", err, attempts)
+		}
+	})
+
+	t.Run("stops when ctx is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		attempts := 0
+		err := retryWithBackoff(ctx, "test", func(ctx context.Context) error {
+			attempts++
+			cancel()
+			return ctx.Err()
+		})
+		if !errors.Is(err, context.Canceled) || attempts != 1 {
+			t.Errorf("got %v after %d attempts, want context.Canceled after 1", err, attempts)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// updatePeerStatus reports the live state of the WireGuard device in the
+// Peer status: the conditions, the observed generation and per gateway
+// handshake and transfer counters.
+func (a *agent) updatePeerStatus(ctx context.Context) error {
+	var gatewayList v1alpha2.GatewayList
+	if err := a.informers.List(ctx, &gatewayList); err != nil {
+		return fmt.Errorf("fetching Gateways: %w", err)
+	}
+	// the device may still have a gateway's next key as a peer
+	gatewayByKey := make(map[wgtypes.Key]string, len(gatewayList.Items))
+	for _, gateway := range gatewayList.Items {
+		for _, k := range []string{gateway.Spec.PublicKey, gateway.Spec.NextPublicKey} {
+			if key, err := wgtypes.ParseKey(k); err == nil {
+				gatewayByKey[key] = gateway.Name
+			}
+		}
+	}
+
+	// the device is read once per update, the API write is retried on conflict
+	wgdev, devErr := a.wg.Device(agentInfName)
+
+	key := client.ObjectKey{Name: a.nodeName, Namespace: metav1.NamespaceSystem}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var peer v1alpha2.Peer
+		if err := a.client.Get(ctx, key, &peer); err != nil {
+			return err
+		}
+		status := peer.Status.DeepCopy()
+		status.ObservedGeneration = peer.Generation
+		status.ActiveGateway = a.activeGateway
+
+		configured := interfaceCondition(wgdev, devErr, peer.Status.MeshIP, peer.Status.MeshIPs)
+		status.Gateways = nil
+		if devErr == nil {
+			status.Gateways = gatewayTunnels(wgdev.Peers, gatewayByKey)
+		}
+		reachable := reachableCondition(status.Gateways, time.Now(), a.handshakeTimeout)
+		ready := metav1.Condition{
+			Type:    v1alpha2.PeerReady,
+			Status:  metav1.ConditionTrue,
+			Reason:  "Ready",
+			Message: "the peer is connected to the mesh",
+		}
+		switch {
+		case configured.Status != metav1.ConditionTrue:
+			ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, configured.Reason, configured.Message
+		case reachable.Status != metav1.ConditionTrue:
+			ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, reachable.Reason, reachable.Message
+		}
+		for _, c := range []metav1.Condition{configured, reachable, ready} {
+			c.ObservedGeneration = peer.Generation
+			meta.SetStatusCondition(&status.Conditions, c)
+		}
+
+		if equality.Semantic.DeepEqual(&peer.Status, status) {
+			return nil
+		}
+		peer.Status = *status
+		return a.client.Status().Update(ctx, &peer)
+	})
+}
+
+// interfaceCondition reports whether the device exists and carries all mesh
+// IPs.
+func interfaceCondition(wgdev *wgtypes.Device, devErr error, meshIP string, meshIPs []string) metav1.Condition {
+	c := metav1.Condition{Type: v1alpha2.PeerInterfaceConfigured, Status: metav1.ConditionFalse}
+	if devErr != nil {
+		c.Reason, c.Message = "DeviceNotFound", devErr.Error()
+		return c
+	}
+	if wgdev.PrivateKey == (wgtypes.Key{}) {
+		c.Reason, c.Message = "NoPrivateKey", "the WireGuard device has no private key"
+		return c
+	}
+	if meshIP == "" {
+		c.Reason, c.Message = "MeshIPPending", "no mesh IP has been assigned yet"
+		return c
+	}
+
+	link, err := netlink.LinkByName(agentInfName)
+	if err != nil {
+		c.Reason, c.Message = "DeviceNotFound", err.Error()
+		return c
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		c.Reason, c.Message = "AddressListFailed", err.Error()
+		return c
+	}
+	if len(meshIPs) == 0 {
+		meshIPs = []string{meshIP}
+	}
+	for _, meshIP := range meshIPs {
+		ip := net.ParseIP(meshIP)
+		if !slices.ContainsFunc(addrs, func(addr netlink.Addr) bool { return addr.IP.Equal(ip) }) {
+			c.Reason, c.Message = "MeshIPNotConfigured", fmt.Sprintf("mesh IP %s is not configured on %s", meshIP, wgdev.Name)
+			return c
+		}
+	}
+	c.Status, c.Reason = metav1.ConditionTrue, "Configured"
+	c.Message = fmt.Sprintf("%s listens on port %d with mesh IPs %s", wgdev.Name, wgdev.ListenPort, strings.Join(meshIPs, ", "))
+	return c
+}
+
+// gatewayTunnels returns the tunnel state of every device peer that belongs
+// to a known gateway. When both keys of a rotating gateway are on the device
+// the one with the latest handshake is reported.
+func gatewayTunnels(peers []wgtypes.Peer, gatewayByKey map[wgtypes.Key]string) []v1alpha2.GatewayTunnelStatus {
+	var tunnels []v1alpha2.GatewayTunnelStatus
+	index := make(map[string]int)
+	for _, p := range peers {
+		name, ok := gatewayByKey[p.PublicKey]
+		if !ok {
+			continue
+		}
+		t := v1alpha2.GatewayTunnelStatus{
+			Name:          name,
+			ReceiveBytes:  p.ReceiveBytes,
+			TransmitBytes: p.TransmitBytes,
+		}
+		if !p.LastHandshakeTime.IsZero() {
+			ts := metav1.NewTime(p.LastHandshakeTime.Truncate(time.Second))
+			t.LastHandshakeTime = &ts
+		}
+		i, seen := index[name]
+		switch {
+		case !seen:
+			index[name] = len(tunnels)
+			tunnels = append(tunnels, t)
+		case t.LastHandshakeTime != nil && (tunnels[i].LastHandshakeTime == nil || tunnels[i].LastHandshakeTime.Before(t.LastHandshakeTime)):
+			tunnels[i] = t
+		}
+	}
+	return tunnels
+}
+
+// reachableCondition is true when any gateway completed a handshake within
+// timeout.
+func reachableCondition(tunnels []v1alpha2.GatewayTunnelStatus, now time.Time, timeout time.Duration) metav1.Condition {
+	c := metav1.Condition{Type: v1alpha2.PeerGatewaysReachable, Status: metav1.ConditionFalse}
+	if len(tunnels) == 0 {
+		c.Reason, c.Message = "NoGatewayPeers", "no gateway is configured on the device"
+		return c
+	}
+	reachable := 0
+	for _, t := range tunnels {
+		if t.LastHandshakeTime != nil && now.Sub(t.LastHandshakeTime.Time) < timeout {
+			reachable++
+		}
+	}
+	c.Message = fmt.Sprintf("%d/%d gateways reachable", reachable, len(tunnels))
+	if reachable == 0 {
+		c.Reason = "NoRecentHandshake"
+		return c
+	}
+	c.Status, c.Reason = metav1.ConditionTrue, "HandshakeCompleted"
+	return c
+}
@@ -9,19 +9,29 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 
-	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha1"
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/hashring"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/keystore"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/meshaddr"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/podroutes"
 	"github.com/vishvananda/netlink"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -33,11 +43,15 @@ var (
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
-	utilruntime.Must(v1alpha1.AddToScheme(scheme))
+	utilruntime.Must(v1alpha2.AddToScheme(scheme))
 }
 
-// port 51820 (gateway)
-// port 51821 (client)
+const (
+	// defaultListenPort is the port gateways listen on unless configured otherwise.
+	defaultListenPort = 51820
+	// defaultPeerPort is dialed for Peers that do not advertise a port.
+	defaultPeerPort = 51821
+)
 
 type WireGuard struct {
 	Attributes *netlink.LinkAttrs
@@ -73,20 +87,50 @@ func main() {
 		podCIDR         string
 		gatewayEndpoint string
 		nodeName        string
+		podName         string
+		keySecretName   string
+		rotateKey       bool
+		rotationPeriod  time.Duration
+		rotationOverlap time.Duration
+		listenPort      int
+		statusInterval  time.Duration
+		handshakeTTL    time.Duration
+		gatewaysPerPeer int
+		shardKey        string
 	)
-	flag.StringVar(&podCIDR, "pod-cidr", "", "Overall pod cidr of the cluster")
+	flag.StringVar(&podCIDR, "pod-cidr", "", "Comma separated IPv4 and IPv6 pod CIDRs of the cluster, each routed to the gateway interface")
 	flag.StringVar(&nodeName, "node-name", "", "Name of the node")
+	flag.StringVar(&podName, "pod-name", "", "Name of the gateway pod, reported in the Gateway status so the controller can tell when it is gone")
 	flag.StringVar(&gatewayEndpoint, "gateway-endpoint", "", "Endpoint of the gateway")
+	flag.IntVar(&listenPort, "listen-port", defaultListenPort, "UDP port the gateway listens on, published in the Gateway resource")
+	flag.StringVar(&keySecretName, "key-secret-name", "", "Name of the kube-system Secret holding the gateway private key (default aks-mesh-gateway-<node-name>)")
+	flag.BoolVar(&rotateKey, "rotate-key", false, "Generate a new private key and replace the one stored in the key Secret")
+	flag.DurationVar(&rotationPeriod, "key-rotation-period", 0, "Lifetime of the private key before it is rotated automatically, 0 disables rotation")
+	flag.DurationVar(&rotationOverlap, "key-rotation-overlap", 2*time.Minute, "How long the next public key is published before the gateway switches to it")
+	flag.DurationVar(&statusInterval, "status-interval", time.Minute, "Interval at which peer inventory and conditions are reported in the Gateway status")
+	flag.DurationVar(&handshakeTTL, "handshake-timeout", 3*time.Minute, "How long after its last handshake a peer still counts as active")
+	flag.IntVar(&gatewaysPerPeer, "gateways-per-peer", 0, "Number of gateways each Peer is assigned to by consistent hashing, this gateway only configures its assigned Peers; 0 configures every Peer. Must match the agents' setting")
+	flag.StringVar(&shardKey, "shard-key", hashring.ShardKeyNodeName, "What Peers are assigned to gateways by, \"node-name\" or \"public-key\". Must match the agents' setting; agents rotating keys require \"node-name\"")
 	flag.Parse()
+	if shardKey != hashring.ShardKeyNodeName && shardKey != hashring.ShardKeyPublicKey {
+		panic(fmt.Sprintf("invalid shard-key %q", shardKey))
+	}
 	if podCIDR == "" {
 		panic("pod-cidr flag is required")
 	}
+	podCIDRs, err := parsePodCIDRs(podCIDR)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse pod-cidr: %s", err))
+	}
 	if nodeName == "" {
 		panic("node-name required")
 	}
 	if gatewayEndpoint == "" {
 		panic("gateway-endpoint required")
 	}
+	if keySecretName == "" {
+		keySecretName = "aks-mesh-gateway-" + nodeName
+	}
 
 	// Create a channel to receive OS signals
 	sigChan := make(chan os.Signal, 1)
@@ -100,7 +144,7 @@ func main() {
 	la.Name = gatewayInfName
 	l := &WireGuard{Attributes: &la}
 
-	err := netlink.LinkAdd(l)
+	err = netlink.LinkAdd(l)
 	if err != nil && !errors.Is(err, os.ErrExist) {
 		panic(err)
 	}
@@ -110,18 +154,6 @@ func main() {
 		log.Fatal(err)
 	}
 
-	addr := netlink.Addr{
-		IPNet: &net.IPNet{
-			// 100.255.254.0/19
-			IP:   net.ParseIP("100.255.224.4"),
-			Mask: net.CIDRMask(19, 32),
-		},
-	}
-	err = netlink.AddrAdd(link, &addr)
-	if err != nil && !errors.Is(err, os.ErrExist) {
-		log.Fatal(err)
-	}
-
 	err = netlink.LinkSetUp(link)
 	if err != nil {
 		log.Fatalf("failed to bring up link: %s", err)
@@ -137,53 +169,71 @@ func main() {
 		log.Fatalf("failed to get wireguard device: %s", err)
 	}
 
-	// todo read secret containing the wireguard config for the gateways
-	// generate a new wireguard private and public key
-	k, err := wgtypes.GeneratePrivateKey()
+	// Get the in-cluster config
+	config, err := rest.InClusterConfig()
 	if err != nil {
-		panic(err)
+		panic(err.Error())
 	}
 
-	log.Printf("wireguard device: %v", wgdev)
-	lisPort := 51820
-	err = cli.ConfigureDevice(wgdev.Name, wgtypes.Config{
-		PrivateKey: &k,
-		ListenPort: &lisPort,
+	c, err := client.New(config, client.Options{
+		Scheme: scheme,
 	})
 	if err != nil {
-		panic(fmt.Sprintf("failed to configure wireguard device: %s", err))
+		panic(fmt.Sprintf("failed to create client: %v", err))
 	}
 
-	// route 10.244.0.0/16 traffic to wg
-	_, podIPNet, err := net.ParseCIDR(podCIDR)
-	if err != nil {
-		panic(fmt.Sprintf("failed to parse podCIDR: %s", err))
+	// with sharding every peer sync needs all Gateways, read from a cache
+	var shards *shardRing
+	if gatewaysPerPeer > 0 {
+		gateways, err := newGatewayCache(context.Background(), config)
+		if err != nil {
+			panic(fmt.Sprintf("failed to start gateway cache: %v", err))
+		}
+		shards = &shardRing{gateways: gateways}
 	}
 
-	route := &netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Dst:       podIPNet,
-		Scope:     netlink.SCOPE_LINK,
+	// the private key lives in a Secret so restarts keep the same public key
+	keys := &keystore.SecretStore{
+		Client:    c,
+		Namespace: v1.NamespaceSystem,
+		Name:      keySecretName,
+	}
+	var k wgtypes.Key
+	if rotateKey {
+		log.Printf("rotating private key stored in secret %s", keySecretName)
+		k, err = keystore.Rotate(context.Background(), keys)
+	} else {
+		var created bool
+		k, created, err = keystore.LoadOrCreate(context.Background(), keys)
+		if created {
+			log.Printf("generated new private key and stored it in secret %s", keySecretName)
+		}
 	}
-	err = netlink.RouteAdd(route)
 	if err != nil {
-		log.Printf("failed to add route: %s", err)
+		panic(fmt.Sprintf("failed to load private key: %v", err))
 	}
 
-	// Get the in-cluster config
-	config, err := rest.InClusterConfig()
+	log.Printf("wireguard device: %v", wgdev)
+	err = cli.ConfigureDevice(wgdev.Name, wgtypes.Config{
+		PrivateKey: &k,
+		ListenPort: &listenPort,
+	})
 	if err != nil {
-		panic(err.Error())
+		panic(fmt.Sprintf("failed to configure wireguard device: %s", err))
 	}
 
-	c, err := client.New(config, client.Options{
-		Scheme: scheme,
-	})
+	// route pod traffic to wg
+	if err := podroutes.Ensure(link, podCIDRs); err != nil {
+		log.Printf("failed to add pod routes: %s", err)
+	}
+
+	// agents prefer gateways in their own zone or region
+	topology, err := nodeTopologyLabels(c, nodeName)
 	if err != nil {
-		panic(fmt.Sprintf("failed to create client: %v", err))
+		panic(fmt.Sprintf("failed to get node topology: %v", err))
 	}
 
-	gw := &v1alpha1.Gateway{}
+	gw := &v1alpha2.Gateway{}
 	err = c.Get(context.Background(), client.ObjectKey{
 		Namespace: v1.NamespaceSystem,
 		Name:      nodeName,
@@ -194,14 +244,16 @@ func main() {
 	}
 
 	if apierrors.IsNotFound(err) {
-		gw = &v1alpha1.Gateway{
+		gw = &v1alpha2.Gateway{
 			ObjectMeta: v1.ObjectMeta{
 				Name:      nodeName,
 				Namespace: v1.NamespaceSystem,
+				Labels:    topology,
 			},
-			Spec: v1alpha1.GatewaySpec{
-				PublicKey: k.PublicKey().String(),
-				Endpoint:  gatewayEndpoint,
+			Spec: v1alpha2.GatewaySpec{
+				PublicKey:  k.PublicKey().String(),
+				Endpoint:   gatewayEndpoint,
+				ListenPort: listenPort,
 			},
 		}
 		err = c.Create(context.Background(), gw)
@@ -209,10 +261,23 @@ func main() {
 			panic(fmt.Sprintf("failed to create gateway: %v", err))
 		}
 	} else {
-		// update if publickey or endpoint has changed
-		if gw.Spec.PublicKey != k.PublicKey().String() || gw.Spec.Endpoint != gatewayEndpoint {
+		// update if publickey, endpoint, port or topology has changed
+		labelsChanged := false
+		for key, value := range topology {
+			if gw.Labels[key] != value {
+				labelsChanged = true
+			}
+		}
+		if gw.Spec.PublicKey != k.PublicKey().String() || gw.Spec.Endpoint != gatewayEndpoint || gw.Spec.ListenPort != listenPort || labelsChanged {
 			gw.Spec.PublicKey = k.PublicKey().String()
 			gw.Spec.Endpoint = gatewayEndpoint
+			gw.Spec.ListenPort = listenPort
+			if gw.Labels == nil {
+				gw.Labels = make(map[string]string, len(topology))
+			}
+			for key, value := range topology {
+				gw.Labels[key] = value
+			}
 			err = c.Update(context.Background(), gw)
 			if err != nil {
 				panic(fmt.Sprintf("failed to update gateway: %v", err))
@@ -220,121 +285,372 @@ func main() {
 		}
 	}
 
-	// List nodes every 2 seconds
-	peerCache := make(map[string]v1alpha1.Peer)
+	// the controller assigns the gateway its own mesh address
+	log.Printf("waiting for mesh IP assignment")
+	err = wait.PollUntilContextCancel(context.Background(), 2*time.Second, true, func(ctx context.Context) (bool, error) {
+		assigned, err := ensureMeshIP(c, link, nodeName)
+		if err != nil {
+			log.Printf("failed to ensure mesh IP: %s", err)
+		}
+		return assigned, nil
+	})
+	if err != nil {
+		log.Fatalf("failed to wait for mesh IP: %s", err)
+	}
+
+	rotator := &keystore.Rotator{
+		Current: keys,
+		Next: &keystore.SecretStore{
+			Client:    c,
+			Namespace: v1.NamespaceSystem,
+			Name:      keySecretName,
+			Field:     "nextPrivateKey",
+		},
+		Period:  rotationPeriod,
+		Overlap: rotationOverlap,
+	}
+	ensureKeyRotation(c, cli, rotator, nodeName)
+	rotationCheck := time.NewTicker(time.Minute)
+	defer rotationCheck.Stop()
+	statusCheck := time.NewTicker(statusInterval)
+	defer statusCheck.Stop()
+
+	// List peers every 2 seconds
+	peerCache := make(map[string]v1alpha2.Peer)
 	wgdev, err = cli.Device(gatewayInfName)
 	if err != nil {
 		log.Fatalf("failed to get wireguard device: %s", err)
 	}
 
 	for _, p := range wgdev.Peers {
-		peerCache[p.PublicKey.String()] = v1alpha1.Peer{}
+		peerCache[p.PublicKey.String()] = v1alpha2.Peer{}
 	}
+	// failedPeers holds why a device peer could not be configured, keyed by
+	// public key like peerCache
+	failedPeers := make(map[string]v1alpha2.PeerFailure)
+	var peers []v1alpha2.Peer
 
 	for {
 		select {
 		case sig := <-sigChan:
-			log.Printf("received signal: %s, performing cleanup", sig)
-			cleanup(nodeName)
+			// the pod routes would point at a device nobody serves, the
+			// device and the Gateway are kept so that a restart does not
+			// drop the peers or the mesh IP, the controller deletes the
+			// Gateway once the node is gone
+			log.Printf("received signal: %s, removing pod routes", sig)
+			if err := podroutes.Ensure(link, nil); err != nil {
+				log.Printf("failed to remove pod routes: %s", err)
+			}
 			return
-		default:
-			time.Sleep(2 * time.Second)
+		case <-rotationCheck.C:
+			ensureKeyRotation(c, cli, rotator, nodeName)
+		case <-statusCheck.C:
+			// the address changes if the controller had to reassign it
+			if _, err := ensureMeshIP(c, link, nodeName); err != nil {
+				log.Printf("failed to ensure mesh IP: %s", err)
+			}
+			if err := podroutes.Ensure(link, podCIDRs); err != nil {
+				log.Printf("failed to ensure pod routes: %s", err)
+			}
+			err = updateGatewayStatus(c, cli, nodeName, podName, peers, failedPeers, handshakeTTL)
+			if err != nil {
+				log.Printf("failed to update gateway status: %s", err)
+			}
+		case <-time.After(2 * time.Second):
 		}
 
-		peers := &v1alpha1.PeerList{}
-		err = c.List(context.Background(), peers)
+		peerList := &v1alpha2.PeerList{}
+		err = c.List(context.Background(), peerList)
 		if err != nil {
 			log.Default().Printf("could not list peers: %s\n", err)
 			continue
 		}
-
-		for _, peer := range peers.Items {
-			if _, ok := peerCache[peer.Spec.PublicKey]; !ok {
-				// add peer to wireguard device
-				cfg := wgtypes.PeerConfig{
-					PublicKey: mustParseKey(peer.Spec.PublicKey),
-					Endpoint:  &net.UDPAddr{IP: net.ParseIP(peer.Spec.Endpoint), Port: 51821},
-					AllowedIPs: []net.IPNet{
-						{
-							IP:   net.ParseIP(peer.Spec.MeshIP),
-							Mask: net.CIDRMask(32, 32),
-						},
-					},
-				}
-
-				for _, allowedIP := range peer.Spec.AllowedIPs {
-					_, ipNet, err := net.ParseCIDR(allowedIP)
-					if err != nil {
-						log.Printf("failed to parse allowed ip: %s", err)
-						continue
-					}
-					cfg.AllowedIPs = append(cfg.AllowedIPs, *ipNet)
-				}
-
-				err = cli.ConfigureDevice(wgdev.Name, wgtypes.Config{
-					Peers:        []wgtypes.PeerConfig{cfg},
-					ReplacePeers: false,
-				})
-				if err != nil {
-					log.Printf("failed to add peer to wireguard device: %s", err)
-					continue
-				}
-				peerCache[peer.Spec.PublicKey] = peer
+		peers = peerList.Items
+		if gatewaysPerPeer > 0 {
+			peers, err = shards.assignedPeers(context.Background(), nodeName, peers, gatewaysPerPeer, shardKey)
+			if err != nil {
+				log.Default().Printf("could not shard peers: %s\n", err)
+				continue
 			}
 		}
+
+		reconcilePeers(cli, peerCache, failedPeers, peers)
 	}
 }
 
-func cleanup(gatewayName string) {
-	// delete the wgg interface if it exists
-	link, err := netlink.LinkByName(gatewayInfName)
-	if err == nil {
-		err = netlink.LinkDel(link)
-		if err != nil {
-			log.Printf("failed to delete link: %s", err)
+// nodeTopologyLabels returns the zone and region labels of the node.
+func nodeTopologyLabels(c client.Client, nodeName string) (map[string]string, error) {
+	node := &corev1.Node{}
+	if err := c.Get(context.Background(), client.ObjectKey{Name: nodeName}, node); err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string, 2)
+	for _, key := range []string{corev1.LabelTopologyZone, corev1.LabelTopologyRegion} {
+		if value, ok := node.Labels[key]; ok {
+			labels[key] = value
 		}
 	}
+	return labels, nil
+}
 
-	// delete the gateway resource
-	config, err := rest.InClusterConfig()
+// ensureMeshIP configures the mesh addresses assigned to the Gateway on link,
+// replacing any other address left behind on it. It reports false until the
+// controller has assigned an address.
+func ensureMeshIP(c client.Client, link netlink.Link, gatewayName string) (bool, error) {
+	gw := &v1alpha2.Gateway{}
+	err := c.Get(context.Background(), client.ObjectKey{Namespace: v1.NamespaceSystem, Name: gatewayName}, gw)
 	if err != nil {
-		panic(err.Error())
+		return false, err
+	}
+	if gw.Status.MeshIP == "" || gw.Status.MeshSubnet == "" {
+		return false, nil
 	}
 
-	c, err := client.New(config, client.Options{
-		Scheme: scheme,
+	meshIPs, err := meshaddr.Addrs(gw.Status.MeshIP, gw.Status.MeshSubnet, gw.Status.MeshIPs, gw.Status.MeshSubnets)
+	if err != nil {
+		return false, err
+	}
+	want := make([]netlink.Addr, 0, len(meshIPs))
+	for i := range meshIPs {
+		want = append(want, netlink.Addr{IPNet: &meshIPs[i]})
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, err
+	}
+	configured := make([]netlink.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() || slices.ContainsFunc(want, addr.Equal) {
+			configured = append(configured, addr)
+			continue
+		}
+		log.Printf("removing stale address %s from %s", addr.IPNet, gatewayInfName)
+		if err := netlink.AddrDel(link, &addr); err != nil {
+			return false, err
+		}
+	}
+	for i := range want {
+		if slices.ContainsFunc(configured, want[i].Equal) {
+			continue
+		}
+		err = netlink.AddrAdd(link, &want[i])
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return false, err
+		}
+		log.Printf("mesh IP %s configured", want[i].IPNet)
+	}
+	return true, nil
+}
+
+// ensureKeyRotation advances scheduled key rotation, switches the device to
+// a rotated key and publishes the current and next public keys in the Gateway
+// spec, and the key fingerprint and rotation time in its status.
+func ensureKeyRotation(c client.Client, cli *wgctrl.Client, rotator *keystore.Rotator, gatewayName string) {
+	ctx := context.Background()
+	state, err := rotator.Step(ctx, time.Now())
+	if err != nil {
+		log.Printf("failed to rotate private key: %s", err)
+		return
+	}
+
+	wgdev, err := cli.Device(gatewayInfName)
+	if err != nil {
+		log.Printf("failed to get wireguard device: %s", err)
+		return
+	}
+	if wgdev.PrivateKey != state.Current {
+		log.Printf("switching wireguard device to rotated key %s", state.Current.PublicKey())
+		err = cli.ConfigureDevice(wgdev.Name, wgtypes.Config{PrivateKey: &state.Current})
+		if err != nil {
+			log.Printf("failed to configure rotated private key: %s", err)
+			return
+		}
+	}
+
+	publicKey := state.Current.PublicKey().String()
+	nextPublicKey := ""
+	if state.Next != nil {
+		nextPublicKey = state.Next.PublicKey().String()
+	}
+	fingerprint := keystore.Fingerprint(state.Current.PublicKey())
+	rotatedAt := v1.NewTime(state.RotatedAt.Truncate(time.Second))
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		gw := &v1alpha2.Gateway{}
+		err := c.Get(ctx, client.ObjectKey{Namespace: v1.NamespaceSystem, Name: gatewayName}, gw)
+		if err != nil {
+			return err
+		}
+		if gw.Spec.PublicKey != publicKey || gw.Spec.NextPublicKey != nextPublicKey {
+			gw.Spec.PublicKey = publicKey
+			gw.Spec.NextPublicKey = nextPublicKey
+			if err := c.Update(ctx, gw); err != nil {
+				return err
+			}
+		}
+		if gw.Status.PublicKeyFingerprint == fingerprint && rotatedAt.Equal(gw.Status.LastKeyRotationTime) {
+			return nil
+		}
+		gw.Status.PublicKeyFingerprint = fingerprint
+		gw.Status.LastKeyRotationTime = &rotatedAt
+		return c.Status().Update(ctx, gw)
 	})
 	if err != nil {
-		panic(fmt.Sprintf("failed to create client: %v", err))
+		log.Printf("failed to publish keys in gateway resource: %s", err)
 	}
-	err = c.Get(context.Background(), client.ObjectKey{
-		Namespace: v1.NamespaceSystem,
-		Name:      gatewayName,
-	}, &v1alpha1.Gateway{})
-	if err != nil && !apierrors.IsNotFound(err) {
-		log.Printf("failed to get gateway: %s", err)
+}
+
+// reconcilePeers brings the wireguard device in line with the Peer objects.
+// peerCache holds the Peer each device peer was last configured from, keyed
+// by public key: peers whose object disappeared are removed from the device and
+// peers whose config changed are re-applied. failed records the peers that
+// could not be configured, under the same keys.
+func reconcilePeers(cli *wgctrl.Client, peerCache map[string]v1alpha2.Peer, failed map[string]v1alpha2.PeerFailure, peers []v1alpha2.Peer) {
+	current := make(map[string]struct{}, len(peers))
+	for _, peer := range programmablePeers(peers) {
+		current[peer.Spec.PublicKey] = struct{}{}
+		configurePeer(cli, peerCache, failed, peer.Spec.PublicKey, peer, true)
+
+		if peer.Spec.NextPublicKey != "" {
+			// accept handshakes from the peer's next key ahead of its
+			// rotation, it takes over the allowed IPs once it is current
+			current[peer.Spec.NextPublicKey] = struct{}{}
+			configurePeer(cli, peerCache, failed, peer.Spec.NextPublicKey, peer, false)
+		}
+	}
+
+	for publicKey := range failed {
+		if _, ok := current[publicKey]; !ok {
+			delete(failed, publicKey)
+		}
+	}
+
+	// evict peers whose Peer object is gone or now uses a different key
+	for publicKey, cached := range peerCache {
+		if _, ok := current[publicKey]; ok {
+			continue
+		}
+		key, err := wgtypes.ParseKey(publicKey)
+		if err != nil {
+			delete(peerCache, publicKey)
+			continue
+		}
+		err = cli.ConfigureDevice(gatewayInfName, wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{{PublicKey: key, Remove: true}},
+		})
+		if err != nil {
+			log.Printf("failed to remove peer %s from wireguard device: %s", publicKey, err)
+			continue
+		}
+		log.Printf("removed peer %s (%s)", cached.Name, publicKey)
+		delete(peerCache, publicKey)
+	}
+}
+
+// programmablePeers returns the Peers to configure on the device: those the
+// controller has assigned a mesh IP and not found invalid. A Peer whose allowed
+// IPs overlap those of an older Peer is invalid and would otherwise take over
+// the older Peer's addresses.
+func programmablePeers(peers []v1alpha2.Peer) []v1alpha2.Peer {
+	programmable := make([]v1alpha2.Peer, 0, len(peers))
+	for _, peer := range peers {
+		if peer.Status.MeshIP == "" || meta.IsStatusConditionFalse(peer.Status.Conditions, v1alpha2.PeerValid) {
+			continue
+		}
+		programmable = append(programmable, peer)
+	}
+	return programmable
+}
+
+// configurePeer adds or updates the device peer with publicKey unless it
+// was already configured from the same version of peer. Without routed, the
+// device peer gets no allowed IPs. A peer that cannot be configured, or only
+// partially, is recorded in failed.
+func configurePeer(cli *wgctrl.Client, peerCache map[string]v1alpha2.Peer, failed map[string]v1alpha2.PeerFailure, publicKey string, peer v1alpha2.Peer, routed bool) {
+	if cached, ok := peerCache[publicKey]; ok && !peerChanged(cached, peer) {
 		return
 	}
-	if apierrors.IsNotFound(err) {
-		log.Printf("gateway resource not found, nothing to do")
+	delete(failed, publicKey)
+	// invalid Peers are cached as well so they are only retried once they change
+	fail := func(reason string) {
+		log.Printf("failed to configure peer %s: %s", peer.Name, reason)
+		failed[publicKey] = v1alpha2.PeerFailure{Name: peer.Name, Reason: reason}
+	}
+
+	key, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		fail(fmt.Sprintf("invalid public key %q: %s", publicKey, err))
+		peerCache[publicKey] = peer
+		return
+	}
+	endpoint := net.ParseIP(peer.Spec.Endpoint)
+	if endpoint == nil {
+		fail(fmt.Sprintf("invalid endpoint %q", peer.Spec.Endpoint))
+		peerCache[publicKey] = peer
 		return
 	}
 
-	err = c.Delete(context.Background(), &v1alpha1.Gateway{
-		ObjectMeta: v1.ObjectMeta{
-			Name:      gatewayName,
-			Namespace: v1.NamespaceSystem,
-		},
+	port := peer.Spec.ListenPort
+	if port == 0 {
+		port = defaultPeerPort
+	}
+
+	// add or update peer on wireguard device
+	cfg := wgtypes.PeerConfig{
+		PublicKey:         key,
+		Endpoint:          &net.UDPAddr{IP: endpoint, Port: port},
+		ReplaceAllowedIPs: true,
+	}
+	var allowedErr error
+	if routed {
+		// the valid allowed IPs are still routed
+		cfg.AllowedIPs, allowedErr = peerAllowedIPs(peer)
+	}
+	err = cli.ConfigureDevice(gatewayInfName, wgtypes.Config{
+		Peers:        []wgtypes.PeerConfig{cfg},
+		ReplacePeers: false,
 	})
 	if err != nil {
-		log.Printf("failed to delete gateway: %s", err)
+		// not cached, retried on the next pass
+		fail(fmt.Sprintf("configuring wireguard device: %s", err))
+		return
+	}
+	log.Printf("configured peer %s (%s)", peer.Name, publicKey)
+	peerCache[publicKey] = peer
+	if allowedErr != nil {
+		fail(allowedErr.Error())
 	}
 }
 
-func mustParseKey(s string) wgtypes.Key {
-	k, err := wgtypes.ParseKey(s)
+// peerAllowedIPs returns the mesh IPs and allowed IPs routed to a Peer, in
+// either IP family. The error lists the addresses that could not be parsed
+// and were left out.
+func peerAllowedIPs(peer v1alpha2.Peer) ([]net.IPNet, error) {
+	var allowedIPs []net.IPNet
+	var errs []error
+	meshIPs, err := meshaddr.Addrs(peer.Status.MeshIP, "", peer.Status.MeshIPs, nil)
 	if err != nil {
-		panic(err)
+		errs = append(errs, err)
+	}
+	for _, meshIP := range meshIPs {
+		allowedIPs = append(allowedIPs, meshaddr.HostNet(meshIP.IP))
 	}
-	return k
+	for _, allowedIP := range peer.Spec.AllowedIPs {
+		ipNet, err := meshaddr.ParseIPOrCIDR(allowedIP)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		allowedIPs = append(allowedIPs, ipNet)
+	}
+	return allowedIPs, errors.Join(errs...)
+}
+
+// peerChanged reports whether the device config derived from a Peer differs
+// between two versions of it.
+func peerChanged(old, updated v1alpha2.Peer) bool {
+	return !equality.Semantic.DeepEqual(old.Spec, updated.Spec) ||
+		old.Status.MeshIP != updated.Status.MeshIP ||
+		!slices.Equal(old.Status.MeshIPs, updated.Status.MeshIPs)
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProgrammablePeers(t *testing.T) {
+	peer := func(name, meshIP string, valid v1.ConditionStatus) v1alpha2.Peer {
+		p := v1alpha2.Peer{ObjectMeta: v1.ObjectMeta{Name: name}, Status: v1alpha2.PeerStatus{MeshIP: meshIP}}
+		if valid != "" {
+			p.Status.Conditions = []v1.Condition{{Type: v1alpha2.PeerValid, Status: valid, Reason: "Conflict"}}
+		}
+		return p
+	}
+	peers := []v1alpha2.Peer{
+		peer("valid", "100.255.224.1", v1.ConditionTrue),
+		peer("not-checked-yet", "100.255.224.2", ""),
+		peer("conflicting", "100.255.224.3", v1.ConditionFalse),
+		peer("no-mesh-ip", "", v1.ConditionTrue),
+	}
+
+	var got []string
+	for _, p := range programmablePeers(peers) {
+		got = append(got, p.Name)
+	}
+	want := []string{"valid", "not-checked-yet"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("programmablePeers() = %v, want %v", got, want)
+	}
+}
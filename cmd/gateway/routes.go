@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parsePodCIDRs parses a comma separated list of IPv4 and IPv6 CIDRs.
+func parsePodCIDRs(s string) ([]net.IPNet, error) {
+	var cidrs []net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, *ipNet)
+	}
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no CIDR in %q", s)
+	}
+	return cidrs, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParsePodCIDRs(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", in: "", wantErr: true},
+		{name: "only separators and whitespace", in: " , ,", wantErr: true},
+		{name: "single IPv4 CIDR", in: "10.244.0.0/16", want: []string{"10.244.0.0/16"}},
+		{name: "whitespace around CIDRs", in: " 10.244.0.0/16 ,\t10.245.0.0/16 ", want: []string{"10.244.0.0/16", "10.245.0.0/16"}},
+		{name: "mixed IPv4 and IPv6", in: "10.244.0.0/16,fd00:10:244::/56", want: []string{"10.244.0.0/16", "fd00:10:244::/56"}},
+		{name: "host bits are masked", in: "10.244.1.7/16", want: []string{"10.244.0.0/16"}},
+		{name: "empty items are skipped", in: "10.244.0.0/16,,", want: []string{"10.244.0.0/16"}},
+		{name: "invalid CIDR", in: "10.244.0.0/16,10.245.0.0", wantErr: true},
+		{name: "address out of range", in: "10.244.0.256/24", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cidrs, err := parsePodCIDRs(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePodCIDRs(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !equalCIDRs(cidrs, tt.want) {
+				t.Errorf("parsePodCIDRs(%q) = %v, want %v", tt.in, cidrs, tt.want)
+			}
+		})
+	}
+}
+
+func equalCIDRs(cidrs []net.IPNet, want []string) bool {
+	if len(cidrs) != len(want) {
+		return false
+	}
+	for i := range cidrs {
+		if cidrs[i].String() != want[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/hashring"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// shardRing assigns Peers to gateways by consistent hashing over all
+// Gateways, so adding or removing a gateway only moves the Peers it gains or
+// loses. The ring is only rebuilt when the set of Gateways changes.
+type shardRing struct {
+	// gateways should be backed by a cache, the Gateways are read on every
+	// peer sync.
+	gateways client.Reader
+	names    []string
+	ring     *hashring.Ring
+}
+
+// newGatewayCache starts an informer backed cache of Gateway objects and
+// waits for it to sync.
+func newGatewayCache(ctx context.Context, cfg *rest.Config) (cache.Cache, error) {
+	c, err := cache.New(cfg, cache.Options{Scheme: scheme})
+	if err != nil {
+		return nil, fmt.Errorf("creating gateway cache: %w", err)
+	}
+	if _, err := c.GetInformer(ctx, &v1alpha2.Gateway{}); err != nil {
+		return nil, fmt.Errorf("creating gateway informer: %w", err)
+	}
+	go func() {
+		if err := c.Start(ctx); err != nil {
+			log.Printf("gateway cache stopped: %s", err)
+		}
+	}()
+	if !c.WaitForCacheSync(ctx) {
+		return nil, fmt.Errorf("gateway cache did not sync")
+	}
+	return c, nil
+}
+
+// assignedPeers returns the Peers assigned to the gateway: every Peer is
+// assigned to n gateways.
+func (s *shardRing) assignedPeers(ctx context.Context, gatewayName string, peers []v1alpha2.Peer, n int, shardKey string) ([]v1alpha2.Peer, error) {
+	gatewayList := &v1alpha2.GatewayList{}
+	if err := s.gateways.List(ctx, gatewayList); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(gatewayList.Items))
+	for _, gw := range gatewayList.Items {
+		names = append(names, gw.Name)
+	}
+	slices.Sort(names)
+	if s.ring == nil || !slices.Equal(names, s.names) {
+		s.names = names
+		s.ring = hashring.New(names, hashring.DefaultVirtualNodes)
+	}
+
+	assigned := make([]v1alpha2.Peer, 0, len(peers))
+	for _, peer := range peers {
+		if s.ring.Owns(gatewayName, hashring.PeerKey(shardKey, peer.Name, peer.Spec.PublicKey), n) {
+			assigned = append(assigned, peer)
+		}
+	}
+	return assigned, nil
+}
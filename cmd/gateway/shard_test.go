@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/hashring"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestShardRingAssignedPeers(t *testing.T) {
+	ctx := context.Background()
+	gateway := func(name string) *v1alpha2.Gateway {
+		return &v1alpha2.Gateway{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: v1.NamespaceSystem}}
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(gateway("gw-a"), gateway("gw-b")).Build()
+	var peers []v1alpha2.Peer
+	for _, name := range []string{"node-1", "node-2", "node-3", "node-4", "node-5", "node-6"} {
+		peers = append(peers, v1alpha2.Peer{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: v1.NamespaceSystem}})
+	}
+
+	// every Peer is assigned to exactly one of the gateways
+	counts := func(s *shardRing, gateways ...string) map[string]int {
+		t.Helper()
+		assigned := make(map[string]int)
+		for _, gw := range gateways {
+			got, err := s.assignedPeers(ctx, gw, peers, 1, hashring.ShardKeyNodeName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, peer := range got {
+				assigned[peer.Name]++
+			}
+		}
+		return assigned
+	}
+	s := &shardRing{gateways: c}
+	assigned := counts(s, "gw-a", "gw-b")
+	for _, peer := range peers {
+		if assigned[peer.Name] != 1 {
+			t.Errorf("Peer %s assigned to %d gateways, want 1", peer.Name, assigned[peer.Name])
+		}
+	}
+	ring := s.ring
+	counts(s, "gw-a")
+	if s.ring != ring {
+		t.Errorf("ring rebuilt although the Gateways did not change")
+	}
+
+	// a new gateway is taken into account
+	if err := c.Create(ctx, gateway("gw-c")); err != nil {
+		t.Fatal(err)
+	}
+	assigned = counts(s, "gw-a", "gw-b", "gw-c")
+	if s.ring == ring {
+		t.Errorf("ring not rebuilt after a Gateway was added")
+	}
+	for _, peer := range peers {
+		if assigned[peer.Name] != 1 {
+			t.Errorf("Peer %s assigned to %d gateways, want 1", peer.Name, assigned[peer.Name])
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// updateGatewayStatus reports the peer inventory of the wireguard device in
+// the Gateway status: how many Peers are configured and active, which failed
+// and the Ready and Degraded conditions, along with the node and pod the
+// gateway runs in. A Peer is active if it completed a handshake within
+// handshakeTTL.
+func updateGatewayStatus(c client.Client, cli *wgctrl.Client, gatewayName, podName string, peers []v1alpha2.Peer, failed map[string]v1alpha2.PeerFailure, handshakeTTL time.Duration) error {
+	ctx := context.Background()
+	wgdev, devErr := cli.Device(gatewayInfName)
+
+	// count device peers by the Peer they belong to, a rotating Peer may
+	// have both its keys on the device
+	peerByKey := make(map[wgtypes.Key]string, len(peers))
+	for _, peer := range peers {
+		for _, k := range []string{peer.Spec.PublicKey, peer.Spec.NextPublicKey} {
+			if key, err := wgtypes.ParseKey(k); err == nil {
+				peerByKey[key] = peer.Name
+			}
+		}
+	}
+	configured := make(map[string]struct{})
+	active := make(map[string]struct{})
+	if devErr == nil {
+		now := time.Now()
+		for _, p := range wgdev.Peers {
+			name, ok := peerByKey[p.PublicKey]
+			if !ok {
+				continue
+			}
+			configured[name] = struct{}{}
+			if !p.LastHandshakeTime.IsZero() && now.Sub(p.LastHandshakeTime) < handshakeTTL {
+				active[name] = struct{}{}
+			}
+		}
+	}
+	failures := peerFailures(failed)
+
+	ready := v1.Condition{
+		Type:    v1alpha2.GatewayReady,
+		Status:  v1.ConditionTrue,
+		Reason:  "Listening",
+		Message: fmt.Sprintf("%s is up", gatewayInfName),
+	}
+	switch {
+	case devErr != nil:
+		ready.Status, ready.Reason, ready.Message = v1.ConditionFalse, "DeviceNotFound", devErr.Error()
+	case wgdev.PrivateKey == (wgtypes.Key{}):
+		ready.Status, ready.Reason, ready.Message = v1.ConditionFalse, "NoPrivateKey", "the wireguard device has no private key"
+	}
+	degraded := v1.Condition{
+		Type:    v1alpha2.GatewayDegraded,
+		Status:  v1.ConditionFalse,
+		Reason:  "AllPeersConfigured",
+		Message: fmt.Sprintf("%d peers configured, %d active", len(configured), len(active)),
+	}
+	if len(failures) > 0 {
+		names := make([]string, 0, len(failures))
+		for _, f := range failures {
+			names = append(names, f.Name)
+		}
+		degraded.Status, degraded.Reason = v1.ConditionTrue, "PeerConfigurationFailed"
+		degraded.Message = fmt.Sprintf("%d peers could not be configured: %s", len(failures), strings.Join(names, ", "))
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		gw := &v1alpha2.Gateway{}
+		err := c.Get(ctx, client.ObjectKey{Namespace: v1.NamespaceSystem, Name: gatewayName}, gw)
+		if err != nil {
+			return err
+		}
+		status := gw.Status.DeepCopy()
+		// the Gateway is named after its node
+		status.NodeName = gatewayName
+		status.PodName = podName
+		if devErr == nil {
+			status.ListenPort = wgdev.ListenPort
+		}
+		status.ConfiguredPeers = len(configured)
+		status.ActivePeers = len(active)
+		status.FailedPeers = failures
+		for _, cond := range []v1.Condition{ready, degraded} {
+			cond.ObservedGeneration = gw.Generation
+			meta.SetStatusCondition(&status.Conditions, cond)
+		}
+
+		if equality.Semantic.DeepEqual(&gw.Status, status) {
+			return nil
+		}
+		gw.Status = *status
+		return c.Status().Update(ctx, gw)
+	})
+}
+
+// peerFailures returns one failure per Peer, sorted by name. The reasons of
+// a Peer whose current and next key both failed are joined.
+func peerFailures(failed map[string]v1alpha2.PeerFailure) []v1alpha2.PeerFailure {
+	byName := make(map[string][]string)
+	for _, f := range failed {
+		byName[f.Name] = append(byName[f.Name], f.Reason)
+	}
+	failures := make([]v1alpha2.PeerFailure, 0, len(byName))
+	for name, reasons := range byName {
+		sort.Strings(reasons)
+		failures = append(failures, v1alpha2.PeerFailure{Name: name, Reason: strings.Join(reasons, "; ")})
+	}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Name < failures[j].Name })
+	if len(failures) == 0 {
+		return nil
+	}
+	return failures
+}
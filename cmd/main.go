@@ -18,24 +18,36 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"flag"
+	"net/netip"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	aksv1alpha1 "github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha1"
+	aksv1alpha2 "github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
 	"github.com/t-chdossa_microsoft/aks-mesh/internal/controller"
+	"github.com/t-chdossa_microsoft/aks-mesh/internal/migration"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/ipam"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -47,7 +59,10 @@ var (
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
+	utilruntime.Must(apiextensionsv1.AddToScheme(scheme))
+
 	utilruntime.Must(aksv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(aksv1alpha2.AddToScheme(scheme))
 	// +kubebuilder:scaffold:scheme
 }
 
@@ -57,6 +72,9 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var meshCIDR string
+	var gatewayHandshakeTimeout time.Duration
+	var gatewayResyncPeriod time.Duration
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metric endpoint binds to. "+
 		"Use the port :8080. If not set, it will be 0 in order to disable the metrics server")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
@@ -67,6 +85,13 @@ func main() {
 		"If set the metrics endpoint is served securely")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&meshCIDR, "mesh-cidr", "100.255.224.0/19",
+		"The subnets mesh IPs are assigned to Peers and Gateways from, comma separated. "+
+			"Add an IPv6 ULA subnet, such as fdaa:5e55:100:ffff::/112, for a dual-stack mesh.")
+	flag.DurationVar(&gatewayHandshakeTimeout, "gateway-handshake-timeout", 3*time.Minute,
+		"How long after a Peer's last handshake with a Gateway the Gateway is still reported reachable.")
+	flag.DurationVar(&gatewayResyncPeriod, "gateway-resync-period", time.Minute,
+		"How often the reachability of every Gateway is recomputed from the handshakes Peers report.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -75,6 +100,22 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	// Peers and Gateways share one pool of mesh addresses per IP family
+	meshIPAM := &controller.MeshIPAM{}
+	for _, cidr := range strings.Split(meshCIDR, ",") {
+		meshSubnet, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		for _, a := range meshIPAM.Allocators {
+			if err == nil && a.Subnet().Addr().Is4() == meshSubnet.Addr().Is4() {
+				err = errors.New("more than one subnet of the same IP family")
+			}
+		}
+		if err != nil {
+			setupLog.Error(err, "invalid mesh-cidr", "cidr", cidr)
+			os.Exit(1)
+		}
+		meshIPAM.Allocators = append(meshIPAM.Allocators, ipam.NewAllocator(meshSubnet))
+	}
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancellation and
@@ -97,6 +138,12 @@ func main() {
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme: scheme,
+		// the Gateway controller only looks at gateway pods, which run in kube-system
+		Cache: cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				&corev1.Pod{}: {Namespaces: map[string]cache.Config{metav1.NamespaceSystem: {}}},
+			},
+		},
 		Metrics: metricsserver.Options{
 			BindAddress:   metricsAddr,
 			SecureServing: secureMetrics,
@@ -124,8 +171,12 @@ func main() {
 	}
 
 	if err = (&controller.GatewayReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:           mgr.GetClient(),
+		Scheme:           mgr.GetScheme(),
+		IPAM:             meshIPAM,
+		Recorder:         mgr.GetEventRecorderFor("gateway-controller"),
+		HandshakeTimeout: gatewayHandshakeTimeout,
+		ResyncPeriod:     gatewayResyncPeriod,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Gateway")
 		os.Exit(1)
@@ -133,12 +184,42 @@ func main() {
 	if err = (&controller.PeerReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
+		IPAM:   meshIPAM,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Peer")
 		os.Exit(1)
 	}
+	// nolint:goconst
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&aksv1alpha2.Peer{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Peer")
+			os.Exit(1)
+		}
+		if err = (&aksv1alpha2.Gateway{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Gateway")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
+	// rewrite Peers and Gateways still stored as v1alpha1, which may carry
+	// private keys, in the v1alpha2 storage version
+	apiClient, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme()})
+	if err != nil {
+		setupLog.Error(err, "unable to create client")
+		os.Exit(1)
+	}
+	if err = mgr.Add(&migration.StorageVersionMigrator{
+		Client: apiClient,
+		Resources: []migration.Resource{
+			{CRD: "peers.aks.azure.com", List: &aksv1alpha2.PeerList{}},
+			{CRD: "gateways.aks.azure.com", List: &aksv1alpha2.GatewayList{}},
+		},
+	}); err != nil {
+		setupLog.Error(err, "unable to add storage version migrator")
+		os.Exit(1)
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -18,130 +18,321 @@ package controller
 
 import (
 	"context"
-	"errors"
-	"net"
-	"os"
-
-	v1alpha1 "github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha1"
-	"github.com/vishvananda/netlink"
-	"golang.zx2c4.com/wireguard/wgctrl"
-	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 // GatewayReconciler reconciles a Gateway object
 type GatewayReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// IPAM assigns mesh addresses to Gateways, from the same pool as Peers.
+	IPAM *MeshIPAM
+	// Recorder records Events on Gateways.
+	Recorder record.EventRecorder
+	// HandshakeTimeout is how long after a Peer's last handshake with a
+	// gateway the gateway still counts as reachable.
+	HandshakeTimeout time.Duration
+	// ResyncPeriod is how often the Reachable condition is recomputed from
+	// the handshakes Peers report. Peer status updates do not trigger a
+	// reconcile, as every Peer reports its handshakes periodically. Zero
+	// disables the periodic recompute.
+	ResyncPeriod time.Duration
 }
 
 // +kubebuilder:rbac:groups=aks.azure.com,resources=gateways,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=aks.azure.com,resources=gateways/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=aks.azure.com,resources=gateways/finalizers,verbs=update
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the Gateway object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
+// Reconcile manages the lifecycle of a Gateway: it deletes the Gateway once
+// its node is gone, assigns it mesh addresses, validates its spec, computes
+// whether Peers reach it from the handshakes they report and marks it not
+// ready once its pod is gone. The WireGuard device and routes are set up by
+// the gateway pod.
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.18.2/pkg/reconcile
 func (r *GatewayReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	//_ = log.FromContext(ctx)
-
-	// TODO(user): your logic here
-	log := ctrl.Log
+	log := ctrl.LoggerFrom(ctx)
 
 	// Fetch the Gateway instance
-	var gateway v1alpha1.Gateway
+	var gateway v1alpha2.Gateway
 	if err := r.Get(ctx, req.NamespacedName, &gateway); err != nil {
-		if client.IgnoreNotFound(err) != nil {
-			log.Error(err, "Failed to get Gateway")
+		if apierrors.IsNotFound(err) {
+			// the Gateway is gone, its mesh address may be handed out again
+			r.IPAM.Release(meshIPOwner("Gateway", req.NamespacedName))
+			return ctrl.Result{}, nil
 		}
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+		log.Error(err, "Failed to get Gateway")
+		return ctrl.Result{}, err
+	}
+
+	deleted, err := r.deleteIfNodeGone(ctx, &gateway)
+	if err != nil {
+		log.Error(err, "Failed to delete Gateway of a deleted node")
+		return ctrl.Result{}, err
+	}
+	if deleted {
+		return ctrl.Result{}, nil
 	}
 
-	// Ensure WireGuard setup
-	if err := r.ensureWireGuardSetup(&gateway); err != nil {
-		log.Error(err, "Failed to ensure WireGuard setup")
+	addrs, err := r.IPAM.Assign(ctx, r, meshIPOwner("Gateway", req.NamespacedName), gateway.Spec.MeshIP)
+	if err != nil {
+		log.Error(err, "Failed to assign mesh IP")
+		return ctrl.Result{}, err
+	}
+	reachable, requeueAfter, err := r.reachableCondition(ctx, &gateway, time.Now())
+	if err != nil {
+		log.Error(err, "Failed to list Peers")
+		return ctrl.Result{}, err
+	}
+	conditions := []metav1.Condition{gatewayValidCondition(&gateway, addrs), reachable}
+	podGone, err := r.podGoneCondition(ctx, &gateway)
+	if err != nil {
+		log.Error(err, "Failed to get gateway pod")
 		return ctrl.Result{}, err
 	}
+	if podGone != nil {
+		conditions = append(conditions, *podGone)
+	}
 
-	return ctrl.Result{}, nil
+	if err := r.updateStatus(ctx, &gateway, addrs, conditions); err != nil {
+		log.Error(err, "Failed to update Gateway status")
+		return ctrl.Result{}, err
+	}
+	if r.ResyncPeriod > 0 && (requeueAfter <= 0 || r.ResyncPeriod < requeueAfter) {
+		requeueAfter = r.ResyncPeriod
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
 }
 
-func (r *GatewayReconciler) ensureWireGuardSetup(gateway *v1alpha1.Gateway) error {
-	la := netlink.NewLinkAttrs()
-	la.Name = "wg0"
-	link := &netlink.GenericLink{LinkAttrs: la, LinkType: "wireguard"}
+// deleteIfNodeGone deletes a Gateway whose node no longer exists. Gateways
+// that do not report a node, such as ones created by hand, are kept.
+func (r *GatewayReconciler) deleteIfNodeGone(ctx context.Context, gateway *v1alpha2.Gateway) (bool, error) {
+	nodeName := gateway.Status.NodeName
+	if nodeName == "" {
+		return false, nil
+	}
+	var node corev1.Node
+	err := r.Get(ctx, client.ObjectKey{Name: nodeName}, &node)
+	if err == nil || !apierrors.IsNotFound(err) {
+		return false, err
+	}
 
-	// Ensure the WireGuard interface exists
-	if err := netlink.LinkAdd(link); err != nil && !errors.Is(err, os.ErrExist) {
-		return err
+	r.Recorder.Eventf(gateway, corev1.EventTypeNormal, "NodeDeleted", "Deleting the Gateway, node %s no longer exists", nodeName)
+	if err := r.Delete(ctx, gateway); client.IgnoreNotFound(err) != nil {
+		return false, err
 	}
+	ctrl.LoggerFrom(ctx).Info("Deleted Gateway of a deleted node", "node", nodeName)
+	return true, nil
+}
 
-	// Get the WireGuard interface
-	wgLink, err := netlink.LinkByName("wg0")
-	if err != nil {
-		return err
+// gatewayValidCondition returns the Valid condition of the Gateway: whether
+// its spec is well formed and whether it got the mesh IP it requested.
+func gatewayValidCondition(gateway *v1alpha2.Gateway, addrs []netip.Addr) metav1.Condition {
+	c := metav1.Condition{
+		Type:               v1alpha2.GatewayValid,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: gateway.Generation,
 	}
+	if err := validateGateway(&gateway.Spec); err != nil {
+		c.Reason, c.Message = reasonInvalidSpec, err.Error()
+		return c
+	}
+	if conflict := meshIPConflict(gateway.Spec.MeshIP, addrs); conflict != "" {
+		c.Reason, c.Message = reasonMeshIPUnavailable, conflict
+		return c
+	}
+	c.Status, c.Reason, c.Message = metav1.ConditionTrue, reasonValid, "the gateway spec is valid"
+	return c
+}
 
-	// Bring the interface up
-	if err := netlink.LinkSetUp(wgLink); err != nil {
-		return err
+// reachableCondition returns the Reachable condition of the Gateway from the
+// handshakes Peers report with it, and how long until the last of those
+// handshakes is too old to count.
+func (r *GatewayReconciler) reachableCondition(ctx context.Context, gateway *v1alpha2.Gateway, now time.Time) (metav1.Condition, time.Duration, error) {
+	var peers v1alpha2.PeerList
+	if err := r.List(ctx, &peers); err != nil {
+		return metav1.Condition{}, 0, err
 	}
 
-	// Configure the WireGuard device
-	cli, err := wgctrl.New()
-	if err != nil {
-		return err
+	var tunnels, recent int
+	var latest time.Time
+	for _, peer := range peers.Items {
+		for _, tunnel := range peer.Status.Gateways {
+			if tunnel.Name != gateway.Name {
+				continue
+			}
+			tunnels++
+			if handshake := tunnel.LastHandshakeTime; handshake != nil && now.Sub(handshake.Time) < r.HandshakeTimeout {
+				recent++
+				if handshake.Time.After(latest) {
+					latest = handshake.Time
+				}
+			}
+		}
 	}
-	defer cli.Close()
-
-	// Create a WireGuard configuration
-	// cfg := wgtypes.Config{
-	// 	Interface: config.Interface{
-	// 		PrivateKey:   gateway.Spec.PrivateKey,
-	// 		ListenPort:   gateway.Spec.ListenPort,
-	// 		ReplacePeers: true,
-	// 	},
-	// 	Peers: []config.Peer{
-	// 		{
-	// 			PublicKey: gateway.Spec.PublicKey,
-	// 			Endpoint:  gateway.Spec.Endpoint,
-	// 		},
-	// 	},
-	// }
-	cfg := wgtypes.Config{}
-	if err := cli.ConfigureDevice("wg0", cfg); err != nil {
-		return err
+
+	c := metav1.Condition{Type: v1alpha2.GatewayReachable, ObservedGeneration: gateway.Generation}
+	switch {
+	case recent > 0:
+		c.Status, c.Reason = metav1.ConditionTrue, "HandshakeCompleted"
+		c.Message = fmt.Sprintf("%d of %d peers completed a handshake within %s", recent, tunnels, r.HandshakeTimeout)
+		return c, latest.Add(r.HandshakeTimeout).Sub(now), nil
+	case tunnels > 0:
+		c.Status, c.Reason = metav1.ConditionFalse, "NoRecentHandshake"
+		c.Message = fmt.Sprintf("none of the %d peers with a tunnel to the gateway completed a handshake within %s", tunnels, r.HandshakeTimeout)
+	default:
+		c.Status, c.Reason, c.Message = metav1.ConditionUnknown, "NoPeers", "no peer reports a tunnel to the gateway"
 	}
+	return c, 0, nil
+}
 
-	// Add a route for the WireGuard network
-	route := &netlink.Route{
-		LinkIndex: wgLink.Attrs().Index,
-		Dst: &net.IPNet{
-			IP:   net.ParseIP("10.244.0.0"),
-			Mask: net.CIDRMask(16, 32),
-		},
+// podGoneCondition returns a false Ready condition if the pod the gateway
+// reported running in is gone, since the gateway can no longer report it
+// itself. It returns nil while the pod runs or if no pod was reported.
+func (r *GatewayReconciler) podGoneCondition(ctx context.Context, gateway *v1alpha2.Gateway) (*metav1.Condition, error) {
+	podName := gateway.Status.PodName
+	if podName == "" {
+		return nil, nil
 	}
-	if err := netlink.RouteAdd(route); err != nil && !errors.Is(err, os.ErrExist) {
+	c := &metav1.Condition{
+		Type:               v1alpha2.GatewayReady,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: gateway.Generation,
+	}
+	var pod corev1.Pod
+	err := r.Get(ctx, client.ObjectKey{Namespace: metav1.NamespaceSystem, Name: podName}, &pod)
+	switch {
+	case apierrors.IsNotFound(err):
+		c.Reason, c.Message = "PodNotFound", fmt.Sprintf("gateway pod %s no longer exists", podName)
+	case err != nil:
+		return nil, err
+	case pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed:
+		c.Reason, c.Message = "PodTerminated", fmt.Sprintf("gateway pod %s has terminated", podName)
+	case pod.DeletionTimestamp != nil:
+		c.Reason, c.Message = "PodTerminating", fmt.Sprintf("gateway pod %s is being deleted", podName)
+	default:
+		return nil, nil
+	}
+	return c, nil
+}
+
+// updateStatus records the mesh addresses and the controller's conditions in
+// the Gateway status, leaving the fields reported by the gateway alone, and
+// records an Event for every condition that changed.
+func (r *GatewayReconciler) updateStatus(ctx context.Context, gateway *v1alpha2.Gateway, addrs []netip.Addr, conditions []metav1.Condition) error {
+	log := ctrl.LoggerFrom(ctx)
+	podName := gateway.Status.PodName
+
+	var assigned bool
+	var changed []metav1.Condition
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var gw v1alpha2.Gateway
+		if err := r.Get(ctx, client.ObjectKeyFromObject(gateway), &gw); err != nil {
+			return err
+		}
+		status := gw.Status.DeepCopy()
+		assigned = setMeshIPs(&status.MeshIP, &status.MeshSubnet, &status.MeshIPs, &status.MeshSubnets, addrs, r.IPAM.Subnets())
+		changed = changed[:0]
+		for _, c := range conditions {
+			// a new gateway pod may have reported in since the old one was found gone
+			if c.Type == v1alpha2.GatewayReady && status.PodName != podName {
+				continue
+			}
+			// a condition first reported as true is not worth an Event
+			prev := meta.FindStatusCondition(status.Conditions, c.Type)
+			if (prev == nil && c.Status == metav1.ConditionFalse) || (prev != nil && (prev.Status != c.Status || prev.Reason != c.Reason)) {
+				changed = append(changed, c)
+			}
+			meta.SetStatusCondition(&status.Conditions, c)
+		}
+
+		if equality.Semantic.DeepEqual(&gw.Status, status) {
+			return nil
+		}
+		gw.Status = *status
+		return r.Status().Update(ctx, &gw)
+	})
+	if err != nil {
 		return err
 	}
 
-	log.Log.Info("WireGuard setup completed for Gateway %s/%s", gateway.Namespace, gateway.Name)
+	if assigned {
+		log.Info("Assigned mesh IP", "meshIPs", addrs)
+	}
+	for _, c := range changed {
+		switch c.Status {
+		case metav1.ConditionFalse:
+			r.Recorder.Event(gateway, corev1.EventTypeWarning, c.Reason, c.Message)
+		case metav1.ConditionTrue:
+			r.Recorder.Event(gateway, corev1.EventTypeNormal, c.Reason, c.Message)
+		}
+	}
 	return nil
 }
 
+// gatewaysReportedBy returns a mapping from an object to the Gateways whose
+// status field returned by reported names it.
+func (r *GatewayReconciler) gatewaysReportedBy(reported func(*v1alpha2.Gateway) string) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		var gateways v1alpha2.GatewayList
+		if err := r.List(ctx, &gateways); err != nil {
+			ctrl.LoggerFrom(ctx).Error(err, "Failed to list Gateways")
+			return nil
+		}
+		var requests []reconcile.Request
+		for i := range gateways.Items {
+			if reported(&gateways.Items[i]) == obj.GetName() {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&gateways.Items[i])})
+			}
+		}
+		return requests
+	}
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *GatewayReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// only the deletion of a node matters, not its frequent status updates
+	nodeDeleted := predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		UpdateFunc:  func(event.UpdateEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+	}
+	inKubeSystem := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return obj.GetNamespace() == metav1.NamespaceSystem
+	})
+
+	// status writes by this controller and the gateway do not trigger a
+	// reconcile, the status is revisited every ResyncPeriod instead
 	return ctrl.NewControllerManagedBy(mgr).
-		// Uncomment the following line adding a pointer to an instance of the controlled resource as an argument
-		For(&v1alpha1.Gateway{}).
+		For(&v1alpha2.Gateway{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&corev1.Node{},
+			handler.EnqueueRequestsFromMapFunc(r.gatewaysReportedBy(func(gw *v1alpha2.Gateway) string { return gw.Status.NodeName })),
+			builder.WithPredicates(nodeDeleted)).
+		Watches(&corev1.Pod{},
+			handler.EnqueueRequestsFromMapFunc(r.gatewaysReportedBy(func(gw *v1alpha2.Gateway) string { return gw.Status.PodName })),
+			builder.WithPredicates(inKubeSystem)).
 		Complete(r)
 }
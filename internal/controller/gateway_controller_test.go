@@ -17,16 +17,226 @@ limitations under the License.
 package controller
 
 import (
+	"context"
+	"net/netip"
+	"time"
+
 	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/ipam"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 var _ = Describe("Gateway Controller", func() {
 	Context("When reconciling a resource", func() {
+		const namespace = metav1.NamespaceSystem
+		ctx := context.Background()
+
+		var (
+			controllerReconciler *GatewayReconciler
+			recorder             *record.FakeRecorder
+		)
+
+		newPublicKey := func() string {
+			key, err := wgtypes.GeneratePrivateKey()
+			Expect(err).NotTo(HaveOccurred())
+			return key.PublicKey().String()
+		}
+
+		// createGateway creates a Gateway the way the gateway pod on the
+		// node does and reports the node and pod it runs in
+		createGateway := func(nodeName, podName string, spec v1alpha2.GatewaySpec) {
+			gateway := &v1alpha2.Gateway{
+				ObjectMeta: metav1.ObjectMeta{Name: nodeName, Namespace: namespace},
+				Spec:       spec,
+			}
+			Expect(k8sClient.Create(ctx, gateway)).To(Succeed())
+			gateway.Status.NodeName = nodeName
+			gateway.Status.PodName = podName
+			meta.SetStatusCondition(&gateway.Status.Conditions, metav1.Condition{
+				Type:   v1alpha2.GatewayReady,
+				Status: metav1.ConditionTrue,
+				Reason: "Listening",
+			})
+			Expect(k8sClient.Status().Update(ctx, gateway)).To(Succeed())
+		}
+
+		createNode := func(name string) {
+			Expect(k8sClient.Create(ctx, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}})).To(Succeed())
+		}
+
+		createPod := func(name, nodeName string) {
+			Expect(k8sClient.Create(ctx, &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Spec: corev1.PodSpec{
+					NodeName:   nodeName,
+					Containers: []corev1.Container{{Name: "gateway", Image: "gateway"}},
+				},
+			})).To(Succeed())
+		}
+
+		reconcileGateway := func(name string) *v1alpha2.Gateway {
+			key := types.NamespacedName{Name: name, Namespace: namespace}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			gateway := &v1alpha2.Gateway{}
+			Expect(k8sClient.Get(ctx, key, gateway)).To(Succeed())
+			return gateway
+		}
+
+		condition := func(gateway *v1alpha2.Gateway, conditionType string) *metav1.Condition {
+			c := meta.FindStatusCondition(gateway.Status.Conditions, conditionType)
+			Expect(c).NotTo(BeNil())
+			return c
+		}
+
+		BeforeEach(func() {
+			recorder = record.NewFakeRecorder(10)
+			controllerReconciler = &GatewayReconciler{
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: recorder,
+				IPAM: &MeshIPAM{
+					Allocators: []*ipam.Allocator{ipam.NewAllocator(netip.MustParsePrefix("100.64.0.0/24"))},
+				},
+				HandshakeTimeout: 3 * time.Minute,
+			}
+		})
+
+		AfterEach(func() {
+			By("Cleanup the Gateways, Peers, Pods and Nodes")
+			Expect(k8sClient.DeleteAllOf(ctx, &v1alpha2.Gateway{}, client.InNamespace(namespace))).To(Succeed())
+			Expect(k8sClient.DeleteAllOf(ctx, &v1alpha2.Peer{}, client.InNamespace(namespace))).To(Succeed())
+			Expect(k8sClient.DeleteAllOf(ctx, &corev1.Pod{}, client.InNamespace(namespace), client.GracePeriodSeconds(0))).To(Succeed())
+			Expect(k8sClient.DeleteAllOf(ctx, &corev1.Node{})).To(Succeed())
+		})
+
+		It("should assign a mesh IP to a valid Gateway", func() {
+			createNode("node-1")
+			createPod("gateway-1", "node-1")
+			createGateway("node-1", "gateway-1", v1alpha2.GatewaySpec{
+				ListenPort: 51820,
+				PublicKey:  newPublicKey(),
+				Endpoint:   "10.224.0.4",
+			})
+
+			gateway := reconcileGateway("node-1")
+			Expect(gateway.Status.MeshIP).NotTo(BeEmpty())
+			Expect(gateway.Status.MeshSubnet).To(Equal("100.64.0.0/24"))
+			Expect(condition(gateway, v1alpha2.GatewayValid).Status).To(Equal(metav1.ConditionTrue))
+			Expect(condition(gateway, v1alpha2.GatewayReady).Status).To(Equal(metav1.ConditionTrue))
+			Expect(condition(gateway, v1alpha2.GatewayReachable).Status).To(Equal(metav1.ConditionUnknown))
+			Expect(recorder.Events).To(BeEmpty())
+		})
+
+		It("should report a malformed spec", func() {
+			createNode("node-1")
+			createPod("gateway-1", "node-1")
+			createGateway("node-1", "gateway-1", v1alpha2.GatewaySpec{
+				ListenPort: 70000,
+				PublicKey:  "not-a-key",
+				Endpoint:   "gateway.example.com",
+			})
+
+			valid := condition(reconcileGateway("node-1"), v1alpha2.GatewayValid)
+			Expect(valid.Status).To(Equal(metav1.ConditionFalse))
+			Expect(valid.Reason).To(Equal(reasonInvalidSpec))
+			Expect(valid.Message).To(And(
+				ContainSubstring("publicKey"),
+				ContainSubstring("listenPort"),
+				ContainSubstring("endpoint"),
+			))
+			Expect(recorder.Events).To(Receive(ContainSubstring("InvalidSpec")))
+		})
+
+		It("should compute reachability from the handshakes Peers report", func() {
+			createNode("node-1")
+			createPod("gateway-1", "node-1")
+			createGateway("node-1", "gateway-1", v1alpha2.GatewaySpec{PublicKey: newPublicKey(), Endpoint: "10.224.0.4"})
+
+			peer := &v1alpha2.Peer{
+				ObjectMeta: metav1.ObjectMeta{Name: "node-2", Namespace: namespace},
+				Spec:       v1alpha2.PeerSpec{PublicKey: newPublicKey(), Endpoint: "10.224.0.5", PodIPs: []string{}},
+			}
+			Expect(k8sClient.Create(ctx, peer)).To(Succeed())
+			handshake := metav1.NewTime(time.Now().Add(-time.Minute))
+			peer.Status.Gateways = []v1alpha2.GatewayTunnelStatus{{Name: "node-1", LastHandshakeTime: &handshake}}
+			Expect(k8sClient.Status().Update(ctx, peer)).To(Succeed())
+
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: "node-1", Namespace: namespace},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			By("revisiting the Gateway when the handshake gets too old")
+			Expect(result.RequeueAfter).To(BeNumerically("~", 2*time.Minute, 5*time.Second))
+
+			gateway := &v1alpha2.Gateway{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "node-1", Namespace: namespace}, gateway)).To(Succeed())
+			Expect(condition(gateway, v1alpha2.GatewayReachable).Status).To(Equal(metav1.ConditionTrue))
+
+			By("reporting the Gateway unreachable once the handshake is too old")
+			stale := metav1.NewTime(time.Now().Add(-time.Hour))
+			peer.Status.Gateways[0].LastHandshakeTime = &stale
+			Expect(k8sClient.Status().Update(ctx, peer)).To(Succeed())
+			reachable := condition(reconcileGateway("node-1"), v1alpha2.GatewayReachable)
+			Expect(reachable.Status).To(Equal(metav1.ConditionFalse))
+			Expect(reachable.Reason).To(Equal("NoRecentHandshake"))
+			Expect(recorder.Events).To(Receive(ContainSubstring("NoRecentHandshake")))
+		})
+
+		It("should revisit a Gateway periodically to recompute its reachability", func() {
+			createNode("node-1")
+			createPod("gateway-1", "node-1")
+			createGateway("node-1", "gateway-1", v1alpha2.GatewaySpec{PublicKey: newPublicKey(), Endpoint: "10.224.0.4"})
+			controllerReconciler.ResyncPeriod = time.Minute
+
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: "node-1", Namespace: namespace},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(time.Minute))
+		})
+
+		It("should mark a Gateway whose pod is gone as not ready", func() {
+			createNode("node-1")
+			createGateway("node-1", "gateway-1", v1alpha2.GatewaySpec{PublicKey: newPublicKey(), Endpoint: "10.224.0.4"})
+
+			ready := condition(reconcileGateway("node-1"), v1alpha2.GatewayReady)
+			Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+			Expect(ready.Reason).To(Equal("PodNotFound"))
+			Expect(recorder.Events).To(Receive(ContainSubstring("PodNotFound")))
+		})
+
+		It("should delete a Gateway whose node is gone", func() {
+			createGateway("node-1", "gateway-1", v1alpha2.GatewaySpec{PublicKey: newPublicKey(), Endpoint: "10.224.0.4"})
+
+			key := types.NamespacedName{Name: "node-1", Namespace: namespace}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			err = k8sClient.Get(ctx, key, &v1alpha2.Gateway{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+			Expect(recorder.Events).To(Receive(ContainSubstring("NodeDeleted")))
+		})
 
-		It("should successfully reconcile the resource", func() {
+		It("should keep a Gateway that does not report a node", func() {
+			Expect(k8sClient.Create(ctx, &v1alpha2.Gateway{
+				ObjectMeta: metav1.ObjectMeta{Name: "external", Namespace: namespace},
+				Spec:       v1alpha2.GatewaySpec{PublicKey: newPublicKey(), Endpoint: "10.224.0.4"},
+			})).To(Succeed())
 
-			// TODO(user): Add more specific assertions depending on your controller's reconciliation logic.
-			// Example: If you expect a certain status condition after reconciliation, verify it here.
+			gateway := reconcileGateway("external")
+			Expect(condition(gateway, v1alpha2.GatewayValid).Status).To(Equal(metav1.ConditionTrue))
+			Expect(meta.FindStatusCondition(gateway.Status.Conditions, v1alpha2.GatewayReady)).To(BeNil())
 		})
 	})
 })
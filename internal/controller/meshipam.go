@@ -0,0 +1,191 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/ipam"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// MeshIPAM assigns mesh addresses to Peers and Gateways from one Allocator
+// per mesh network, so no two members of the mesh share an address. A
+// dual-stack mesh has an IPv4 and an IPv6 Allocator and every member gets an
+// address from each. Assignments are recorded in the objects' status, which
+// is what makes them durable.
+type MeshIPAM struct {
+	Allocators []*ipam.Allocator
+
+	// restored is set once the Allocators have been seeded with the addresses
+	// already recorded in Peer and Gateway statuses.
+	restoreMu sync.Mutex
+	restored  bool
+}
+
+// meshIPOwner returns the allocator owner of an object. Peers and Gateways
+// are both named after their node, so the kind is part of the owner.
+func meshIPOwner(kind string, key client.ObjectKey) string {
+	return kind + "/" + key.String()
+}
+
+// Assign returns the mesh addresses of owner, one per Allocator, allocating
+// those it does not hold yet. A requested address is honoured if it belongs
+// to a mesh network and nobody else holds it.
+func (m *MeshIPAM) Assign(ctx context.Context, c client.Reader, owner, requested string) ([]netip.Addr, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	if err := m.restore(ctx, c); err != nil {
+		return nil, fmt.Errorf("restoring mesh IP allocations: %w", err)
+	}
+
+	if requested != "" {
+		addr, err := netip.ParseAddr(requested)
+		if err == nil {
+			err = m.reserve(owner, addr)
+		}
+		if err != nil {
+			log.Info("Ignoring requested mesh IP", "meshIP", requested, "reason", err.Error())
+		}
+	}
+	addrs := make([]netip.Addr, 0, len(m.Allocators))
+	for _, a := range m.Allocators {
+		addr, err := a.Allocate(owner)
+		if err != nil {
+			return nil, fmt.Errorf("allocating from %s: %w", a.Subnet(), err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// Release returns the addresses of owner to the pool.
+func (m *MeshIPAM) Release(owner string) {
+	for _, a := range m.Allocators {
+		a.Release(owner)
+	}
+}
+
+// Subnets returns the mesh networks addresses are assigned from, in the order
+// Assign returns the addresses.
+func (m *MeshIPAM) Subnets() []netip.Prefix {
+	subnets := make([]netip.Prefix, 0, len(m.Allocators))
+	for _, a := range m.Allocators {
+		subnets = append(subnets, a.Subnet())
+	}
+	return subnets
+}
+
+// reserve records that owner holds addr in the Allocator of addr's network,
+// unless owner already holds an address there.
+func (m *MeshIPAM) reserve(owner string, addr netip.Addr) error {
+	for _, a := range m.Allocators {
+		if !a.Subnet().Contains(addr) {
+			continue
+		}
+		if _, ok := a.Lookup(owner); ok {
+			return nil
+		}
+		return a.Reserve(owner, addr)
+	}
+	return fmt.Errorf("%s: %w", addr, ipam.ErrOutOfRange)
+}
+
+// restore reserves the mesh addresses recorded in existing Peer and Gateway
+// statuses, so a restarted controller never hands out an address that is
+// still in use. An object whose recorded address conflicts with an earlier
+// one is given a new address when it is reconciled.
+func (m *MeshIPAM) restore(ctx context.Context, c client.Reader) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	m.restoreMu.Lock()
+	defer m.restoreMu.Unlock()
+	if m.restored {
+		return nil
+	}
+
+	var peers v1alpha2.PeerList
+	if err := c.List(ctx, &peers); err != nil {
+		return err
+	}
+	var gateways v1alpha2.GatewayList
+	if err := c.List(ctx, &gateways); err != nil {
+		return err
+	}
+
+	type assignment struct {
+		owner   string
+		meshIPs []string
+	}
+	recorded := make([]assignment, 0, len(peers.Items)+len(gateways.Items))
+	for _, p := range peers.Items {
+		recorded = append(recorded, assignment{meshIPOwner("Peer", client.ObjectKeyFromObject(&p)), statusMeshIPs(p.Status.MeshIP, p.Status.MeshIPs)})
+	}
+	for _, gw := range gateways.Items {
+		recorded = append(recorded, assignment{meshIPOwner("Gateway", client.ObjectKeyFromObject(&gw)), statusMeshIPs(gw.Status.MeshIP, gw.Status.MeshIPs)})
+	}
+	for _, a := range recorded {
+		for _, meshIP := range a.meshIPs {
+			ip, err := netip.ParseAddr(meshIP)
+			if err == nil {
+				err = m.reserve(a.owner, ip)
+			}
+			if err != nil {
+				log.Info("Not restoring mesh IP", "owner", a.owner, "meshIP", meshIP, "reason", err.Error())
+			}
+		}
+	}
+	m.restored = true
+	return nil
+}
+
+// statusMeshIPs returns the mesh addresses recorded in a status. Objects
+// assigned an address before dual-stack support only record meshIP.
+func statusMeshIPs(meshIP string, meshIPs []string) []string {
+	if len(meshIPs) > 0 {
+		return meshIPs
+	}
+	if meshIP != "" {
+		return []string{meshIP}
+	}
+	return nil
+}
+
+// setMeshIPs records addrs, allocated from subnets, in the mesh IP fields of a
+// Peer or Gateway status and reports whether any changed.
+func setMeshIPs(meshIP, meshSubnet *string, meshIPs, meshSubnets *[]string, addrs []netip.Addr, subnets []netip.Prefix) bool {
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.String())
+	}
+	nets := make([]string, 0, len(subnets))
+	for _, subnet := range subnets {
+		nets = append(nets, subnet.String())
+	}
+	if *meshIP == ips[0] && *meshSubnet == nets[0] && slices.Equal(*meshIPs, ips) && slices.Equal(*meshSubnets, nets) {
+		return false
+	}
+	*meshIP, *meshSubnet = ips[0], nets[0]
+	*meshIPs, *meshSubnets = ips, nets
+	return true
+}
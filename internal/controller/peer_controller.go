@@ -18,144 +18,178 @@ package controller
 
 import (
 	"context"
-	"errors"
-	"net"
-	"os"
-
-	v1alpha1 "github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha1"
-	"github.com/vishvananda/netlink"
-	"golang.zx2c4.com/wireguard/wgctrl"
-	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net/netip"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 // PeerReconciler reconciles a Peer object
 type PeerReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// IPAM assigns mesh addresses to Peers.
+	IPAM *MeshIPAM
 }
 
 // +kubebuilder:rbac:groups=aks.azure.com,resources=peers,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=aks.azure.com,resources=peers/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=aks.azure.com,resources=peers/finalizers,verbs=update
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the Peer object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
+// Reconcile validates a Peer, checks it against the other Peers, assigns it
+// mesh addresses and reports the outcome in the Peer status. The WireGuard
+// device and routes are set up by the agent on the Peer's node.
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.18.2/pkg/reconcile
 func (r *PeerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	//_ = log.FromContext(ctx)
-
-	// TODO(user): your logic here
 	log := ctrl.LoggerFrom(ctx)
 
 	// Fetch the Peer instance
-	var peer v1alpha1.Peer
+	var peer v1alpha2.Peer
 	if err := r.Get(ctx, req.NamespacedName, &peer); err != nil {
-		if client.IgnoreNotFound(err) != nil {
-			log.Error(err, "Failed to get Peer")
+		if apierrors.IsNotFound(err) {
+			// the Peer is gone, its mesh address may be handed out again
+			r.IPAM.Release(meshIPOwner("Peer", req.NamespacedName))
+			return ctrl.Result{}, nil
 		}
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+		log.Error(err, "Failed to get Peer")
+		return ctrl.Result{}, err
 	}
 
-	// Ensure WireGuard setup
-	if err := r.ensureWireGuardSetup(&peer); err != nil {
-		log.Error(err, "Failed to ensure WireGuard setup")
+	var peers v1alpha2.PeerList
+	if err := r.List(ctx, &peers); err != nil {
+		log.Error(err, "Failed to list Peers")
 		return ctrl.Result{}, err
 	}
 
-	//example logic to update the status of the peer
-	// peer.Status.Conditions = append(peer.Status.Conditions, metav1.Condition{
-	// 	Type:    "Ready",
-	// 	Status:  metav1.ConditionTrue,
-	// 	Reason:  "Reconciled",
-	// 	Message: "Peer successfully reconciled",
-	// })
-	if err := r.Status().Update(ctx, &peer); err != nil {
-		log.Error(err, "unable to update Peer status")
+	// an invalid or conflicting Peer keeps its mesh address, so that fixing
+	// the spec does not renumber it
+	addrs, err := r.IPAM.Assign(ctx, r, meshIPOwner("Peer", req.NamespacedName), peer.Spec.MeshIP)
+	if err != nil {
+		log.Error(err, "Failed to assign mesh IP")
 		return ctrl.Result{}, err
 	}
+	valid := r.validCondition(&peer, peers.Items, addrs)
+	if valid.Status != metav1.ConditionTrue {
+		log.Info("Peer is not valid", "reason", valid.Reason, "message", valid.Message)
+	}
 
+	if err := r.updateStatus(ctx, req.NamespacedName, addrs, valid); err != nil {
+		log.Error(err, "Failed to update Peer status")
+		return ctrl.Result{}, err
+	}
 	return ctrl.Result{}, nil
 }
 
-// ensureWireGuardSetup ensures the WireGuard setup for the Peer
-func (r *PeerReconciler) ensureWireGuardSetup(peer *v1alpha1.Peer) error {
-	la := netlink.NewLinkAttrs()
-	la.Name = "wg0"
-	link := &netlink.GenericLink{LinkAttrs: la, LinkType: "wireguard"}
-
-	// Ensure the WireGuard interface exists
-	if err := netlink.LinkAdd(link); err != nil && !errors.Is(err, os.ErrExist) {
-		return err
+// validCondition returns the Valid condition of the Peer: whether its spec is
+// well formed, whether an older Peer already uses its keys or allowed IPs and
+// whether it got the mesh IP it requested.
+func (r *PeerReconciler) validCondition(peer *v1alpha2.Peer, peers []v1alpha2.Peer, addrs []netip.Addr) metav1.Condition {
+	c := metav1.Condition{
+		Type:               v1alpha2.PeerValid,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: peer.Generation,
 	}
-
-	// Get the WireGuard interface
-	wgLink, err := netlink.LinkByName("wg0")
-	if err != nil {
-		return err
+	if err := validatePeer(&peer.Spec); err != nil {
+		c.Reason, c.Message = reasonInvalidSpec, err.Error()
+		return c
 	}
-
-	// Bring the interface up
-	if err := netlink.LinkSetUp(wgLink); err != nil {
-		return err
+	if conflict := meshConflict(peer, r.IPAM.Subnets()); conflict != "" {
+		c.Reason, c.Message = reasonConflict, conflict
+		return c
 	}
-
-	// Configure the WireGuard device
-	cli, err := wgctrl.New()
-	if err != nil {
-		return err
+	for i := range peers {
+		other := &peers[i]
+		if other.UID == peer.UID || peerPrecedes(peer, other) {
+			continue
+		}
+		if conflict := peerConflict(peer, other); conflict != "" {
+			c.Reason, c.Message = reasonConflict, conflict
+			return c
+		}
 	}
-	defer cli.Close()
-
-	// Create a WireGuard configuration
-	// cfg := config.Config{
-	// 	Interface: config.Interface{
-	// 		PrivateKey:   peer.Spec.PrivateKey,
-	// 		ListenPort:   peer.Spec.ListenPort,
-	// 		ReplacePeers: true,
-	// 	},
-	// 	Peers: []config.Peer{
-	// 		{
-	// 			PublicKey:  peer.Spec.PublicKey,
-	// 			Endpoint:   peer.Spec.Endpoint,
-	// 			AllowedIPs: peer.Spec.PodIPs,
-	// 		},
-	// 	},
-	// }
-	cfg := wgtypes.Config{}
-	if err := cli.ConfigureDevice("wg0", cfg); err != nil {
-		return err
+	if conflict := meshIPConflict(peer.Spec.MeshIP, addrs); conflict != "" {
+		c.Reason, c.Message = reasonMeshIPUnavailable, conflict
+		return c
 	}
+	c.Status, c.Reason, c.Message = metav1.ConditionTrue, reasonValid, "the peer spec is valid"
+	return c
+}
+
+// updateStatus records the mesh addresses and the Valid condition in the Peer
+// status, leaving the fields reported by the agent alone.
+func (r *PeerReconciler) updateStatus(ctx context.Context, key client.ObjectKey, addrs []netip.Addr, valid metav1.Condition) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var peer v1alpha2.Peer
+		if err := r.Get(ctx, key, &peer); err != nil {
+			return err
+		}
+		status := peer.Status.DeepCopy()
+		assigned := setMeshIPs(&status.MeshIP, &status.MeshSubnet, &status.MeshIPs, &status.MeshSubnets, addrs, r.IPAM.Subnets())
+		meta.SetStatusCondition(&status.Conditions, valid)
+
+		if equality.Semantic.DeepEqual(&peer.Status, status) {
+			return nil
+		}
+		peer.Status = *status
+		if err := r.Status().Update(ctx, &peer); err != nil {
+			return err
+		}
+		if assigned {
+			log.Info("Assigned mesh IP", "meshIPs", status.MeshIPs)
+		}
+		return nil
+	})
+}
 
-	// Add a route for the WireGuard network
-	route := &netlink.Route{
-		LinkIndex: wgLink.Attrs().Index,
-		Dst: &net.IPNet{
-			IP:   net.ParseIP("10.244.0.0"),
-			Mask: net.CIDRMask(16, 32),
-		},
+// conflictingPeers returns the Peers to revisit when a Peer changes: those
+// that conflict with it and those already reported as conflicting, which the
+// change may have resolved.
+func (r *PeerReconciler) conflictingPeers(ctx context.Context, obj client.Object) []reconcile.Request {
+	changed, ok := obj.(*v1alpha2.Peer)
+	if !ok {
+		return nil
 	}
-	if err := netlink.RouteAdd(route); err != nil && !errors.Is(err, os.ErrExist) {
-		return err
+	var peers v1alpha2.PeerList
+	if err := r.List(ctx, &peers); err != nil {
+		ctrl.LoggerFrom(ctx).Error(err, "Failed to list Peers")
+		return nil
 	}
-
-	log.Log.Info("WireGuard setup completed for Peer %s/%s", peer.Namespace, peer.Name)
-	return nil
+	var requests []reconcile.Request
+	for i := range peers.Items {
+		peer := &peers.Items[i]
+		if peer.UID == changed.UID {
+			continue
+		}
+		valid := meta.FindStatusCondition(peer.Status.Conditions, v1alpha2.PeerValid)
+		if (valid != nil && valid.Reason == reasonConflict) || peerConflict(peer, changed) != "" {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(peer)})
+		}
+	}
+	return requests
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *PeerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// the Peer status is written by this controller and the agents, only a
+	// changed spec can change the outcome of a reconcile
 	return ctrl.NewControllerManagedBy(mgr).
-		// Uncomment the following line adding a pointer to an instance of the controlled resource as an argument
-		For(&v1alpha1.Peer{}).
+		For(&v1alpha2.Peer{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&v1alpha2.Peer{}, handler.EnqueueRequestsFromMapFunc(r.conflictingPeers),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
 		Complete(r)
 }
@@ -17,16 +17,183 @@ limitations under the License.
 package controller
 
 import (
+	"context"
+	"net/netip"
+
 	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/ipam"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 var _ = Describe("Peer Controller", func() {
 	Context("When reconciling a resource", func() {
+		const namespace = "default"
+		ctx := context.Background()
+
+		var controllerReconciler *PeerReconciler
+
+		newPublicKey := func() string {
+			key, err := wgtypes.GeneratePrivateKey()
+			Expect(err).NotTo(HaveOccurred())
+			return key.PublicKey().String()
+		}
+
+		createPeer := func(name string, spec v1alpha2.PeerSpec) {
+			if spec.PodIPs == nil {
+				// podIPs is a required field
+				spec.PodIPs = []string{}
+			}
+			peer := &v1alpha2.Peer{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Spec:       spec,
+			}
+			Expect(k8sClient.Create(ctx, peer)).To(Succeed())
+		}
+
+		reconcilePeer := func(name string) *v1alpha2.Peer {
+			key := types.NamespacedName{Name: name, Namespace: namespace}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			peer := &v1alpha2.Peer{}
+			Expect(k8sClient.Get(ctx, key, peer)).To(Succeed())
+			return peer
+		}
+
+		validCondition := func(peer *v1alpha2.Peer) *metav1.Condition {
+			valid := meta.FindStatusCondition(peer.Status.Conditions, v1alpha2.PeerValid)
+			Expect(valid).NotTo(BeNil())
+			return valid
+		}
+
+		BeforeEach(func() {
+			controllerReconciler = &PeerReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+				IPAM: &MeshIPAM{
+					Allocators: []*ipam.Allocator{ipam.NewAllocator(netip.MustParsePrefix("100.64.0.0/24"))},
+				},
+			}
+		})
+
+		AfterEach(func() {
+			By("Cleanup the Peers")
+			Expect(k8sClient.DeleteAllOf(ctx, &v1alpha2.Peer{}, client.InNamespace(namespace))).To(Succeed())
+		})
+
+		It("should assign a mesh IP to a valid Peer", func() {
+			createPeer("node-1", v1alpha2.PeerSpec{
+				ListenPort: 51820,
+				PublicKey:  newPublicKey(),
+				Endpoint:   "10.224.0.4",
+				PodIPs:     []string{"10.224.0.4"},
+				AllowedIPs: []string{"10.241.0.0/28"},
+			})
+
+			peer := reconcilePeer("node-1")
+			Expect(peer.Status.MeshIP).NotTo(BeEmpty())
+			Expect(peer.Status.MeshSubnet).To(Equal("100.64.0.0/24"))
+			Expect(peer.Status.MeshIPs).To(Equal([]string{peer.Status.MeshIP}))
+
+			valid := validCondition(peer)
+			Expect(valid.Status).To(Equal(metav1.ConditionTrue))
+			Expect(valid.ObservedGeneration).To(Equal(peer.Generation))
+		})
+
+		It("should report a malformed spec", func() {
+			createPeer("node-1", v1alpha2.PeerSpec{
+				PublicKey:  "not-a-key",
+				Endpoint:   "node-1.example.com",
+				AllowedIPs: []string{"10.241.0.0/33"},
+			})
+
+			peer := reconcilePeer("node-1")
+			valid := validCondition(peer)
+			Expect(valid.Status).To(Equal(metav1.ConditionFalse))
+			Expect(valid.Reason).To(Equal(reasonInvalidSpec))
+			Expect(valid.Message).To(And(
+				ContainSubstring("publicKey"),
+				ContainSubstring("endpoint"),
+				ContainSubstring("10.241.0.0/33"),
+			))
+
+			By("keeping the mesh IP so that fixing the spec does not renumber the Peer")
+			Expect(peer.Status.MeshIP).NotTo(BeEmpty())
+		})
+
+		It("should report a Peer reusing the public key of an older Peer", func() {
+			publicKey := newPublicKey()
+			createPeer("node-1", v1alpha2.PeerSpec{PublicKey: publicKey, Endpoint: "10.224.0.4"})
+			createPeer("node-2", v1alpha2.PeerSpec{PublicKey: publicKey, Endpoint: "10.224.0.5"})
+
+			Expect(validCondition(reconcilePeer("node-1")).Status).To(Equal(metav1.ConditionTrue))
+			valid := validCondition(reconcilePeer("node-2"))
+			Expect(valid.Status).To(Equal(metav1.ConditionFalse))
+			Expect(valid.Reason).To(Equal(reasonConflict))
+			Expect(valid.Message).To(ContainSubstring("node-1"))
+
+			By("clearing the conflict once the older Peer is gone")
+			Expect(k8sClient.Delete(ctx, &v1alpha2.Peer{
+				ObjectMeta: metav1.ObjectMeta{Name: "node-1", Namespace: namespace},
+			})).To(Succeed())
+			reconcilePeer("node-1")
+			Expect(validCondition(reconcilePeer("node-2")).Status).To(Equal(metav1.ConditionTrue))
+		})
+
+		It("should report overlapping allowed IPs", func() {
+			createPeer("node-1", v1alpha2.PeerSpec{
+				PublicKey:  newPublicKey(),
+				Endpoint:   "10.224.0.4",
+				AllowedIPs: []string{"10.241.0.0/28"},
+			})
+			createPeer("node-2", v1alpha2.PeerSpec{
+				PublicKey:  newPublicKey(),
+				Endpoint:   "10.224.0.5",
+				AllowedIPs: []string{"10.241.0.7"},
+			})
+			createPeer("node-3", v1alpha2.PeerSpec{
+				PublicKey:  newPublicKey(),
+				Endpoint:   "10.224.0.6",
+				AllowedIPs: []string{"100.64.0.0/16"},
+			})
+
+			Expect(validCondition(reconcilePeer("node-1")).Status).To(Equal(metav1.ConditionTrue))
+			valid := validCondition(reconcilePeer("node-2"))
+			Expect(valid.Reason).To(Equal(reasonConflict))
+			Expect(valid.Message).To(ContainSubstring("10.241.0.0/28"))
+
+			By("rejecting allowed IPs inside the mesh network")
+			valid = validCondition(reconcilePeer("node-3"))
+			Expect(valid.Reason).To(Equal(reasonConflict))
+			Expect(valid.Message).To(ContainSubstring("mesh network"))
+		})
+
+		It("should honor a requested mesh IP", func() {
+			createPeer("node-1", v1alpha2.PeerSpec{
+				PublicKey: newPublicKey(),
+				Endpoint:  "10.224.0.4",
+				MeshIP:    "100.64.0.42",
+			})
+			createPeer("node-2", v1alpha2.PeerSpec{
+				PublicKey: newPublicKey(),
+				Endpoint:  "10.224.0.5",
+				MeshIP:    "100.64.0.42",
+			})
 
-		It("should successfully reconcile the resource", func() {
+			peer := reconcilePeer("node-1")
+			Expect(peer.Status.MeshIP).To(Equal("100.64.0.42"))
+			Expect(validCondition(peer).Status).To(Equal(metav1.ConditionTrue))
 
-			// TODO(user): Add more specific assertions depending on your controller's reconciliation logic.
-			// Example: If you expect a certain status condition after reconciliation, verify it here.
+			peer = reconcilePeer("node-2")
+			Expect(peer.Status.MeshIP).NotTo(Equal("100.64.0.42"))
+			Expect(validCondition(peer).Reason).To(Equal(reasonMeshIPUnavailable))
 		})
 	})
 })
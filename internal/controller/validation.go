@@ -0,0 +1,186 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/meshaddr"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Reasons of the Valid condition of Peers and Gateways.
+const (
+	reasonValid             = "Valid"
+	reasonInvalidSpec       = "InvalidSpec"
+	reasonConflict          = "Conflict"
+	reasonMeshIPUnavailable = "MeshIPUnavailable"
+)
+
+// validatePeer checks the fields of a Peer spec that agents and gateways
+// build their WireGuard configuration from.
+func validatePeer(spec *v1alpha2.PeerSpec) error {
+	errs := []error{
+		validateKeys(spec.PublicKey, spec.NextPublicKey),
+		validateEndpoint(spec.Endpoint, spec.ListenPort),
+		validateMeshIP(spec.MeshIP),
+	}
+	for _, podIP := range spec.PodIPs {
+		if _, err := netip.ParseAddr(podIP); err != nil {
+			errs = append(errs, fmt.Errorf("invalid pod IP %q", podIP))
+		}
+	}
+	for _, allowedIP := range spec.AllowedIPs {
+		if _, err := meshaddr.ParsePrefix(allowedIP); err != nil {
+			errs = append(errs, fmt.Errorf("invalid allowed IP: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateGateway checks the fields of a Gateway spec that agents build
+// their WireGuard configuration from.
+func validateGateway(spec *v1alpha2.GatewaySpec) error {
+	return errors.Join(
+		validateKeys(spec.PublicKey, spec.NextPublicKey),
+		validateEndpoint(spec.Endpoint, spec.ListenPort),
+		validateMeshIP(spec.MeshIP),
+	)
+}
+
+// validateKeys checks the current and the optional next public key.
+func validateKeys(publicKey, nextPublicKey string) error {
+	current, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("invalid publicKey: %w", err)
+	}
+	if nextPublicKey == "" {
+		return nil
+	}
+	next, err := wgtypes.ParseKey(nextPublicKey)
+	switch {
+	case err != nil:
+		return fmt.Errorf("invalid nextPublicKey: %w", err)
+	case next == current:
+		return errors.New("nextPublicKey is the same as publicKey")
+	}
+	return nil
+}
+
+// validateEndpoint checks the address and port counterparts dial.
+func validateEndpoint(endpoint string, listenPort int) error {
+	var errs []error
+	if listenPort < 0 || listenPort > 65535 {
+		errs = append(errs, fmt.Errorf("listenPort %d is out of range", listenPort))
+	}
+	if _, err := netip.ParseAddr(endpoint); err != nil {
+		errs = append(errs, fmt.Errorf("invalid endpoint %q", endpoint))
+	}
+	return errors.Join(errs...)
+}
+
+// validateMeshIP checks the optional requested mesh IP.
+func validateMeshIP(meshIP string) error {
+	if meshIP == "" {
+		return nil
+	}
+	if _, err := netip.ParseAddr(meshIP); err != nil {
+		return fmt.Errorf("invalid meshIP %q", meshIP)
+	}
+	return nil
+}
+
+// meshIPConflict reports a requested mesh IP that was not assigned because
+// another Peer or Gateway holds it. It returns an empty string if the
+// request was honored or there was none.
+func meshIPConflict(requested string, addrs []netip.Addr) string {
+	if requested == "" {
+		return ""
+	}
+	addr, err := netip.ParseAddr(requested)
+	if err == nil && slices.Contains(addrs, addr.Unmap()) {
+		return ""
+	}
+	return fmt.Sprintf("the requested mesh IP %s is not available, %v was assigned instead", requested, addrs)
+}
+
+// peerConflict reports why two Peers cannot both be part of the mesh: a
+// WireGuard device holds a single peer per public key and routes each
+// allowed IP to a single peer. It returns an empty string if they can.
+func peerConflict(peer, other *v1alpha2.Peer) string {
+	keys := peerKeys(other)
+	for _, key := range []string{peer.Spec.PublicKey, peer.Spec.NextPublicKey} {
+		if key != "" && keys[key] {
+			return fmt.Sprintf("public key %s is also used by Peer %s", key, other.Name)
+		}
+	}
+	for _, allowedIP := range peer.Spec.AllowedIPs {
+		prefix, err := meshaddr.ParsePrefix(allowedIP)
+		if err != nil {
+			continue
+		}
+		for _, otherIP := range other.Spec.AllowedIPs {
+			otherPrefix, err := meshaddr.ParsePrefix(otherIP)
+			if err == nil && prefix.Overlaps(otherPrefix) {
+				return fmt.Sprintf("allowed IP %s overlaps %s of Peer %s", prefix, otherPrefix, other.Name)
+			}
+		}
+	}
+	return ""
+}
+
+// meshConflict reports an allowed IP of the Peer that overlaps a mesh
+// network, which would take mesh traffic away from the gateways.
+func meshConflict(peer *v1alpha2.Peer, subnets []netip.Prefix) string {
+	for _, allowedIP := range peer.Spec.AllowedIPs {
+		prefix, err := meshaddr.ParsePrefix(allowedIP)
+		if err != nil {
+			continue
+		}
+		for _, subnet := range subnets {
+			if prefix.Overlaps(subnet) {
+				return fmt.Sprintf("allowed IP %s overlaps the mesh network %s", prefix, subnet)
+			}
+		}
+	}
+	return ""
+}
+
+// peerKeys returns the public keys the Peer is reachable with.
+func peerKeys(peer *v1alpha2.Peer) map[string]bool {
+	keys := map[string]bool{peer.Spec.PublicKey: true}
+	if peer.Spec.NextPublicKey != "" {
+		keys[peer.Spec.NextPublicKey] = true
+	}
+	return keys
+}
+
+// peerPrecedes reports whether a keeps its place in the mesh when it
+// conflicts with b: the Peer created first wins, ties are broken by name.
+func peerPrecedes(a, b *v1alpha2.Peer) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
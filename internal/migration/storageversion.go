@@ -0,0 +1,137 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package migration rewrites custom resources stored in an older API version.
+package migration
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// Resource is a custom resource to migrate.
+type Resource struct {
+	// CRD is the name of the CustomResourceDefinition, e.g. peers.aks.azure.com.
+	CRD string
+	// List is an empty list of the resource in the storage version.
+	List client.ObjectList
+}
+
+// StorageVersionMigrator rewrites every object of its Resources that may be
+// stored in an older version, then drops the older versions from the CRD's
+// status.storedVersions. It runs once when the manager is elected leader and
+// does nothing for CRDs that only have the storage version stored.
+type StorageVersionMigrator struct {
+	// Client must read from the API server, not from a cache.
+	Client    client.Client
+	Resources []Resource
+}
+
+var _ manager.Runnable = &StorageVersionMigrator{}
+var _ manager.LeaderElectionRunnable = &StorageVersionMigrator{}
+
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions/status,verbs=get;update;patch
+
+// Start migrates all Resources, retrying with backoff until it succeeds or
+// ctx is done. Failures are logged rather than returned so they do not stop
+// the manager; the migration runs again on the next start.
+func (m *StorageVersionMigrator) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("storage-version-migrator")
+	backoff := wait.Backoff{Duration: time.Second, Factor: 2, Jitter: 0.1, Steps: 8, Cap: time.Minute}
+	for _, res := range m.Resources {
+		err := wait.ExponentialBackoffWithContext(ctx, backoff, func(ctx context.Context) (bool, error) {
+			if err := m.migrate(ctx, res); err != nil {
+				logger.Error(err, "Storage version migration failed, retrying", "crd", res.CRD)
+				return false, nil
+			}
+			return true, nil
+		})
+		if err != nil {
+			logger.Error(err, "Giving up storage version migration", "crd", res.CRD)
+		}
+	}
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.
+func (m *StorageVersionMigrator) NeedLeaderElection() bool {
+	return true
+}
+
+func (m *StorageVersionMigrator) migrate(ctx context.Context, res Resource) error {
+	logger := log.FromContext(ctx).WithName("storage-version-migrator")
+
+	var crd apiextensionsv1.CustomResourceDefinition
+	if err := m.Client.Get(ctx, client.ObjectKey{Name: res.CRD}, &crd); err != nil {
+		return fmt.Errorf("getting CRD: %w", err)
+	}
+	storageVersion := ""
+	for _, v := range crd.Spec.Versions {
+		if v.Storage {
+			storageVersion = v.Name
+		}
+	}
+	if storageVersion == "" {
+		return fmt.Errorf("CRD %s has no storage version", res.CRD)
+	}
+	stored := crd.Status.StoredVersions
+	if len(stored) == 1 && stored[0] == storageVersion {
+		return nil
+	}
+	logger.Info("Migrating objects to storage version", "crd", res.CRD, "storedVersions", stored, "storageVersion", storageVersion)
+
+	// an empty patch makes the API server re-encode the object in the
+	// storage version, dropping fields the storage version does not have
+	list := res.List.DeepCopyObject().(client.ObjectList)
+	if err := m.Client.List(ctx, list); err != nil {
+		return fmt.Errorf("listing objects: %w", err)
+	}
+	objs, err := meta.ExtractList(list)
+	if err != nil {
+		return fmt.Errorf("extracting objects: %w", err)
+	}
+	for _, o := range objs {
+		obj := o.(client.Object)
+		err := m.Client.Patch(ctx, obj, client.RawPatch(types.MergePatchType, []byte("{}")))
+		if client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("rewriting %s: %w", client.ObjectKeyFromObject(obj), err)
+		}
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := m.Client.Get(ctx, client.ObjectKey{Name: res.CRD}, &crd); err != nil {
+			return err
+		}
+		crd.Status.StoredVersions = []string{storageVersion}
+		return m.Client.Status().Update(ctx, &crd)
+	})
+	if err != nil {
+		return fmt.Errorf("updating stored versions: %w", err)
+	}
+	logger.Info("Migrated objects to storage version", "crd", res.CRD, "objects", len(objs), "storageVersion", storageVersion)
+	return nil
+}
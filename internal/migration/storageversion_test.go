@@ -0,0 +1,110 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/t-chdossa_microsoft/aks-mesh/api/v1alpha2"
+)
+
+func newCRD(storedVersions ...string) *apiextensionsv1.CustomResourceDefinition {
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "gateways.aks.azure.com"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+				{Name: "v1alpha1", Served: true},
+				{Name: "v1alpha2", Served: true, Storage: true},
+			},
+		},
+		Status: apiextensionsv1.CustomResourceDefinitionStatus{StoredVersions: storedVersions},
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := apiextensionsv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1alpha2.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		storedVersions []string
+		wantRewritten  bool
+	}{
+		{name: "older version stored", storedVersions: []string{"v1alpha1", "v1alpha2"}, wantRewritten: true},
+		{name: "only storage version stored", storedVersions: []string{"v1alpha2"}, wantRewritten: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			gateway := &v1alpha2.Gateway{
+				ObjectMeta: metav1.ObjectMeta{Name: "node-1", Namespace: "kube-system"},
+				Spec:       v1alpha2.GatewaySpec{PublicKey: "pub", Endpoint: "10.224.0.4", MeshIP: "100.255.224.1"},
+				Status:     v1alpha2.GatewayStatus{MeshIPs: []string{"100.255.224.1"}, NodeName: "node-1"},
+			}
+			c := fake.NewClientBuilder().
+				WithScheme(scheme).
+				WithObjects(newCRD(tt.storedVersions...), gateway).
+				WithStatusSubresource(&apiextensionsv1.CustomResourceDefinition{}, &v1alpha2.Gateway{}).
+				Build()
+			before := &v1alpha2.Gateway{}
+			if err := c.Get(ctx, client.ObjectKeyFromObject(gateway), before); err != nil {
+				t.Fatal(err)
+			}
+
+			m := &StorageVersionMigrator{
+				Client:    c,
+				Resources: []Resource{{CRD: "gateways.aks.azure.com", List: &v1alpha2.GatewayList{}}},
+			}
+			if err := m.migrate(ctx, m.Resources[0]); err != nil {
+				t.Fatalf("migrate: %v", err)
+			}
+
+			after := &v1alpha2.Gateway{}
+			if err := c.Get(ctx, client.ObjectKeyFromObject(gateway), after); err != nil {
+				t.Fatal(err)
+			}
+			if rewritten := after.ResourceVersion != before.ResourceVersion; rewritten != tt.wantRewritten {
+				t.Errorf("Gateway rewritten = %v, want %v", rewritten, tt.wantRewritten)
+			}
+			if after.Spec.MeshIP != gateway.Spec.MeshIP || !slices.Equal(after.Status.MeshIPs, gateway.Status.MeshIPs) ||
+				after.Status.NodeName != gateway.Status.NodeName {
+				t.Errorf("migration changed the Gateway: got spec %+v status %+v", after.Spec, after.Status)
+			}
+
+			crd := &apiextensionsv1.CustomResourceDefinition{}
+			if err := c.Get(ctx, client.ObjectKey{Name: "gateways.aks.azure.com"}, crd); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(crd.Status.StoredVersions, []string{"v1alpha2"}) {
+				t.Errorf("storedVersions = %v, want [v1alpha2]", crd.Status.StoredVersions)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Package fake provides an in-memory acn.NncGetter for tests.
+package fake
+
+import (
+	"context"
+	"sync"
+
+	acnv1alpha "github.com/Azure/azure-container-networking/crd/nodenetworkconfig/api/v1alpha"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/acn"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// NncGetter holds NodeNetworkConfigs in memory, keyed by node name. The zero
+// value is ready to use.
+type NncGetter struct {
+	mu       sync.Mutex
+	nncs     map[string]*acnv1alpha.NodeNetworkConfig
+	watchers map[string][]func(*acnv1alpha.NodeNetworkConfig)
+}
+
+var _ acn.NncGetter = &NncGetter{}
+
+// NewNncGetter returns a NncGetter holding nncs.
+func NewNncGetter(nncs ...*acnv1alpha.NodeNetworkConfig) *NncGetter {
+	g := &NncGetter{}
+	for _, nnc := range nncs {
+		g.Set(nnc)
+	}
+	return g
+}
+
+// Set stores nnc under its name and, if its network containers changed,
+// notifies the watchers of that node.
+func (g *NncGetter) Set(nnc *acnv1alpha.NodeNetworkConfig) {
+	g.mu.Lock()
+	if g.nncs == nil {
+		g.nncs = make(map[string]*acnv1alpha.NodeNetworkConfig)
+	}
+	old, existed := g.nncs[nnc.Name]
+	g.nncs[nnc.Name] = nnc.DeepCopy()
+	watchers := g.watchers[nnc.Name]
+	g.mu.Unlock()
+
+	if existed && equality.Semantic.DeepEqual(old.Status.NetworkContainers, nnc.Status.NetworkContainers) {
+		return
+	}
+	for _, onChange := range watchers {
+		onChange(nnc.DeepCopy())
+	}
+}
+
+// Delete removes the NodeNetworkConfig of a node.
+func (g *NncGetter) Delete(nodeName string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.nncs, nodeName)
+}
+
+// GetNnc implements acn.NncGetter. It returns a NotFound API error for nodes
+// without a NodeNetworkConfig.
+func (g *NncGetter) GetNnc(_ context.Context, nodeName string) (*acnv1alpha.NodeNetworkConfig, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	nnc, ok := g.nncs[nodeName]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Group: acnv1alpha.GroupVersion.Group, Resource: "nodenetworkconfigs"}, nodeName)
+	}
+	return nnc.DeepCopy(), nil
+}
+
+// WatchNnc implements acn.NncGetter. onChange is called with the current
+// NodeNetworkConfig right away if there is one, and on every later Set that
+// changes its network containers. The watch ends when ctx is done.
+func (g *NncGetter) WatchNnc(ctx context.Context, nodeName string, onChange func(*acnv1alpha.NodeNetworkConfig)) error {
+	var stopped bool
+	var mu sync.Mutex
+	watcher := func(nnc *acnv1alpha.NodeNetworkConfig) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !stopped {
+			onChange(nnc)
+		}
+	}
+
+	g.mu.Lock()
+	if g.watchers == nil {
+		g.watchers = make(map[string][]func(*acnv1alpha.NodeNetworkConfig))
+	}
+	g.watchers[nodeName] = append(g.watchers[nodeName], watcher)
+	current, ok := g.nncs[nodeName]
+	g.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+	}()
+	if ok {
+		watcher(current.DeepCopy())
+	}
+	return nil
+}
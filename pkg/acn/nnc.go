@@ -2,11 +2,20 @@ package acn
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
 
 	acnv1alpha "github.com/Azure/azure-container-networking/crd/nodenetworkconfig/api/v1alpha"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/meshaddr"
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -16,28 +25,146 @@ func init() {
 	_ = acnv1alpha.AddToScheme(scheme)
 }
 
+// DefaultNamespace is where Azure CNI keeps NodeNetworkConfigs.
+const DefaultNamespace = metav1.NamespaceSystem
+
+// NncGetter reads the NodeNetworkConfig of a node, which Azure CNI names
+// after the node.
+type NncGetter interface {
+	// GetNnc returns the NodeNetworkConfig of the node.
+	GetNnc(ctx context.Context, nodeName string) (*acnv1alpha.NodeNetworkConfig, error)
+	// WatchNnc calls onChange with the NodeNetworkConfig of the node when it
+	// is first seen and whenever its network containers change, until ctx is
+	// done. It returns once the watch is established.
+	WatchNnc(ctx context.Context, nodeName string, onChange func(*acnv1alpha.NodeNetworkConfig)) error
+}
+
+// NncClient reads NodeNetworkConfigs from the API server.
 type NncClient struct {
-	client client.Client
+	client    client.Client
+	cfg       *rest.Config
+	namespace string
 }
 
-func NewNncClient(cfg *rest.Config) *NncClient {
+var _ NncGetter = &NncClient{}
+
+// NewNncClient returns a client for the NodeNetworkConfigs in namespace, or
+// in DefaultNamespace if namespace is empty.
+func NewNncClient(cfg *rest.Config, namespace string) (*NncClient, error) {
 	c, err := client.New(cfg, client.Options{
 		Scheme: scheme,
 	})
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("creating NodeNetworkConfig client: %w", err)
 	}
-	return &NncClient{client: c}
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	return &NncClient{client: c, cfg: cfg, namespace: namespace}, nil
 }
 
-func (n *NncClient) GetNnc(nodeName string) (*acnv1alpha.NodeNetworkConfig, error) {
+// GetNnc implements NncGetter.
+func (n *NncClient) GetNnc(ctx context.Context, nodeName string) (*acnv1alpha.NodeNetworkConfig, error) {
 	nnc := &acnv1alpha.NodeNetworkConfig{}
-	err := n.client.Get(context.TODO(), client.ObjectKey{
+	err := n.client.Get(ctx, client.ObjectKey{
 		Name:      nodeName,
-		Namespace: metav1.NamespaceSystem,
+		Namespace: n.namespace,
 	}, nnc)
 	if err != nil {
 		return nil, err
 	}
 	return nnc, nil
 }
+
+// GetPodPrefixes returns every pod-facing prefix the node owns, read from
+// its NodeNetworkConfig. See PodPrefixes.
+func GetPodPrefixes(ctx context.Context, g NncGetter, nodeName string) ([]netip.Prefix, error) {
+	nnc, err := g.GetNnc(ctx, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	return PodPrefixes(nnc)
+}
+
+// PodPrefixes returns the pod-facing prefixes of all network containers in
+// nnc: the primary IP or block of each container, every IP or block in its
+// IP assignments and the container's subnet address space, so pods addressed
+// from the subnet without a listed assignment are routed too. They are
+// returned in order and without duplicates. A plain address is a single
+// address prefix. Entries that do not parse are left out and reported in the
+// error together with the valid prefixes.
+func PodPrefixes(nnc *acnv1alpha.NodeNetworkConfig) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	var errs []error
+	seen := make(map[netip.Prefix]struct{})
+	for _, nc := range nnc.Status.NetworkContainers {
+		entries := make([]string, 0, len(nc.IPAssignments)+2)
+		if nc.PrimaryIP != "" {
+			entries = append(entries, nc.PrimaryIP)
+		}
+		for _, assignment := range nc.IPAssignments {
+			entries = append(entries, assignment.IP)
+		}
+		if nc.SubnetAddressSpace != "" {
+			entries = append(entries, nc.SubnetAddressSpace)
+		}
+		for _, entry := range entries {
+			prefix, err := meshaddr.ParsePrefix(entry)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("network container %s: %w", nc.ID, err))
+				continue
+			}
+			if _, ok := seen[prefix]; ok {
+				continue
+			}
+			seen[prefix] = struct{}{}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, errors.Join(errs...)
+}
+
+// WatchNnc implements NncGetter.
+func (n *NncClient) WatchNnc(ctx context.Context, nodeName string, onChange func(*acnv1alpha.NodeNetworkConfig)) error {
+	c, err := cache.New(n.cfg, cache.Options{
+		Scheme:            scheme,
+		DefaultNamespaces: map[string]cache.Config{n.namespace: {}},
+		ByObject: map[client.Object]cache.ByObject{
+			&acnv1alpha.NodeNetworkConfig{}: {Field: fields.OneTermEqualSelector("metadata.name", nodeName)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("creating NodeNetworkConfig cache: %w", err)
+	}
+	informer, err := c.GetInformer(ctx, &acnv1alpha.NodeNetworkConfig{})
+	if err != nil {
+		return fmt.Errorf("creating NodeNetworkConfig informer: %w", err)
+	}
+	_, err = informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if nnc, ok := obj.(*acnv1alpha.NodeNetworkConfig); ok {
+				onChange(nnc)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNnc, ok1 := oldObj.(*acnv1alpha.NodeNetworkConfig)
+			newNnc, ok2 := newObj.(*acnv1alpha.NodeNetworkConfig)
+			if ok1 && ok2 && !equality.Semantic.DeepEqual(oldNnc.Status.NetworkContainers, newNnc.Status.NetworkContainers) {
+				onChange(newNnc)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("registering NodeNetworkConfig event handler: %w", err)
+	}
+
+	go func() {
+		if err := c.Start(ctx); err != nil {
+			log.Printf("NodeNetworkConfig cache stopped: %v", err)
+		}
+	}()
+	if !c.WaitForCacheSync(ctx) {
+		return fmt.Errorf("NodeNetworkConfig cache did not sync")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package acn
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	acnv1alpha "github.com/Azure/azure-container-networking/crd/nodenetworkconfig/api/v1alpha"
+)
+
+func TestPodPrefixes(t *testing.T) {
+	nnc := &acnv1alpha.NodeNetworkConfig{
+		Status: acnv1alpha.NodeNetworkConfigStatus{
+			NetworkContainers: []acnv1alpha.NetworkContainer{
+				{
+					ID:                 "nc-vnet",
+					PrimaryIP:          "10.241.0.4",
+					SubnetAddressSpace: "10.241.0.0/16",
+					IPAssignments: []acnv1alpha.IPAssignment{
+						{Name: "a", IP: "10.241.0.5"},
+						{Name: "b", IP: "10.241.0.6"},
+						{Name: "c", IP: "10.241.0.4"},
+					},
+				},
+				{
+					// a second container in the same subnet
+					ID:                 "nc-vnet-2",
+					PrimaryIP:          "10.241.0.9",
+					SubnetAddressSpace: "10.241.0.0/16",
+				},
+				{
+					ID:        "nc-block",
+					Type:      acnv1alpha.VNETBlock,
+					PrimaryIP: "10.224.0.19/28",
+					IPAssignments: []acnv1alpha.IPAssignment{
+						{Name: "d", IP: "10.224.0.32/28"},
+						{Name: "e", IP: "fd00:10:224::/80"},
+					},
+				},
+			},
+		},
+	}
+
+	prefixes, err := PodPrefixes(nnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.241.0.4/32"),
+		netip.MustParsePrefix("10.241.0.5/32"),
+		netip.MustParsePrefix("10.241.0.6/32"),
+		netip.MustParsePrefix("10.241.0.0/16"),
+		netip.MustParsePrefix("10.241.0.9/32"),
+		netip.MustParsePrefix("10.224.0.16/28"),
+		netip.MustParsePrefix("10.224.0.32/28"),
+		netip.MustParsePrefix("fd00:10:224::/80"),
+	}
+	if !slices.Equal(prefixes, want) {
+		t.Fatalf("expected %v, got %v", want, prefixes)
+	}
+}
+
+func TestPodPrefixesSkipsInvalid(t *testing.T) {
+	nnc := &acnv1alpha.NodeNetworkConfig{
+		Status: acnv1alpha.NodeNetworkConfigStatus{
+			NetworkContainers: []acnv1alpha.NetworkContainer{{
+				ID:            "nc",
+				PrimaryIP:     "10.241.0.4",
+				IPAssignments: []acnv1alpha.IPAssignment{{Name: "a", IP: "not-an-ip"}},
+			}},
+		},
+	}
+
+	prefixes, err := PodPrefixes(nnc)
+	if err == nil {
+		t.Fatal("expected the invalid assignment to be reported")
+	}
+	if !slices.Equal(prefixes, []netip.Prefix{netip.MustParsePrefix("10.241.0.4/32")}) {
+		t.Fatalf("expected the valid primary IP to be kept, got %v", prefixes)
+	}
+}
@@ -0,0 +1,111 @@
+// Package hashring assigns keys to members with consistent hashing, so that
+// adding or removing a member only moves the keys that member gains or loses.
+package hashring
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// What Peers are assigned to gateways by, set with --shard-key on the agents
+// and gateways.
+const (
+	// ShardKeyNodeName assigns Peers to gateways by node name, which is
+	// stable across key rotation.
+	ShardKeyNodeName = "node-name"
+	// ShardKeyPublicKey assigns Peers to gateways by their public key.
+	ShardKeyPublicKey = "public-key"
+)
+
+// PeerKey returns the key a Peer is placed on the ring by.
+func PeerKey(shardKey, nodeName, publicKey string) string {
+	if shardKey == ShardKeyPublicKey {
+		return publicKey
+	}
+	return nodeName
+}
+
+// DefaultVirtualNodes is the number of points each member gets on the ring
+// unless configured otherwise. More points spread keys more evenly.
+const DefaultVirtualNodes = 128
+
+// Ring is an immutable consistent hash ring. Rings built from the same members
+// assign every key the same way, in any process.
+type Ring struct {
+	points  []point
+	members int
+}
+
+type point struct {
+	hash   uint64
+	member string
+}
+
+// New returns a ring with virtualNodes points per member. Duplicate members
+// are ignored and the order of members does not matter.
+func New(members []string, virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	seen := make(map[string]struct{}, len(members))
+	r := &Ring{}
+	for _, m := range members {
+		if _, ok := seen[m]; ok {
+			continue
+		}
+		seen[m] = struct{}{}
+		for i := 0; i < virtualNodes; i++ {
+			r.points = append(r.points, point{hash: hash(m + "#" + strconv.Itoa(i)), member: m})
+		}
+	}
+	r.members = len(seen)
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].member < r.points[j].member
+	})
+	return r
+}
+
+// Owners returns the n distinct members responsible for key, the primary
+// owner first. It returns every member if the ring has fewer than n.
+func (r *Ring) Owners(key string, n int) []string {
+	if n > r.members {
+		n = r.members
+	}
+	if n <= 0 {
+		return nil
+	}
+	h := hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	owners := make([]string, 0, n)
+	for i := 0; len(owners) < n; i++ {
+		m := r.points[(start+i)%len(r.points)].member
+		if !contains(owners, m) {
+			owners = append(owners, m)
+		}
+	}
+	return owners
+}
+
+// Owns reports whether member is one of the n owners of key.
+func (r *Ring) Owns(member, key string, n int) bool {
+	return contains(r.Owners(key, n), member)
+}
+
+func hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func contains(members []string, m string) bool {
+	for _, o := range members {
+		if o == m {
+			return true
+		}
+	}
+	return false
+}
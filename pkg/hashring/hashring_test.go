@@ -0,0 +1,104 @@
+package hashring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func keys(n int) []string {
+	ks := make([]string, n)
+	for i := range ks {
+		ks[i] = fmt.Sprintf("aks-nodepool1-%d-vmss%06d", i%7, i)
+	}
+	return ks
+}
+
+func TestOwnersDeterministic(t *testing.T) {
+	a := New([]string{"gw-a", "gw-b", "gw-c"}, 0)
+	b := New([]string{"gw-c", "gw-a", "gw-b", "gw-a"}, 0)
+	for _, k := range keys(500) {
+		oa, ob := a.Owners(k, 2), b.Owners(k, 2)
+		if fmt.Sprint(oa) != fmt.Sprint(ob) {
+			t.Fatalf("owners of %s differ: %v and %v", k, oa, ob)
+		}
+		if len(oa) != 2 || oa[0] == oa[1] {
+			t.Fatalf("expected two distinct owners of %s, got %v", k, oa)
+		}
+	}
+}
+
+func TestOwnersFewerMembers(t *testing.T) {
+	r := New([]string{"gw-a", "gw-b"}, 0)
+	if owners := r.Owners("node", 3); len(owners) != 2 {
+		t.Fatalf("expected both members, got %v", owners)
+	}
+	if owners := New(nil, 0).Owners("node", 2); len(owners) != 0 {
+		t.Fatalf("expected no owners on an empty ring, got %v", owners)
+	}
+}
+
+func TestBalance(t *testing.T) {
+	members := []string{"gw-a", "gw-b", "gw-c", "gw-d"}
+	r := New(members, 0)
+	counts := map[string]int{}
+	ks := keys(10000)
+	for _, k := range ks {
+		counts[r.Owners(k, 1)[0]]++
+	}
+	for _, m := range members {
+		share := float64(counts[m]) / float64(len(ks))
+		if share < 0.15 || share > 0.35 {
+			t.Fatalf("member %s owns %.2f of the keys: %v", m, share, counts)
+		}
+	}
+}
+
+func TestAddMovesMinimum(t *testing.T) {
+	before := New([]string{"gw-a", "gw-b", "gw-c"}, 0)
+	after := New([]string{"gw-a", "gw-b", "gw-c", "gw-d"}, 0)
+	moved := 0
+	ks := keys(10000)
+	for _, k := range ks {
+		o1, o2 := before.Owners(k, 1)[0], after.Owners(k, 1)[0]
+		if o1 == o2 {
+			continue
+		}
+		if o2 != "gw-d" {
+			t.Fatalf("%s moved from %s to %s, not to the new member", k, o1, o2)
+		}
+		moved++
+	}
+	if share := float64(moved) / float64(len(ks)); share > 0.35 {
+		t.Fatalf("%.2f of the keys moved, expected about a quarter", share)
+	}
+}
+
+func TestRemoveKeepsReplica(t *testing.T) {
+	before := New([]string{"gw-a", "gw-b", "gw-c"}, 0)
+	after := New([]string{"gw-a", "gw-c"}, 0)
+	for _, k := range keys(2000) {
+		owners := before.Owners(k, 2)
+		if !before.Owns(owners[0], k, 2) {
+			t.Fatalf("Owns disagrees with Owners for %s", k)
+		}
+		if owners[0] != "gw-b" {
+			if got := after.Owners(k, 1)[0]; got != owners[0] {
+				t.Fatalf("%s moved from %s to %s though its owner stayed", k, owners[0], got)
+			}
+			continue
+		}
+		// the replica takes over the keys of a removed member
+		if got := after.Owners(k, 1)[0]; got != owners[1] {
+			t.Fatalf("%s moved to %s, expected its replica %s", k, got, owners[1])
+		}
+	}
+}
+
+func TestPeerKey(t *testing.T) {
+	if key := PeerKey(ShardKeyNodeName, "node-1", "key-1"); key != "node-1" {
+		t.Fatalf("expected the node name, got %s", key)
+	}
+	if key := PeerKey(ShardKeyPublicKey, "node-1", "key-1"); key != "key-1" {
+		t.Fatalf("expected the public key, got %s", key)
+	}
+}
@@ -0,0 +1,163 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+var (
+	// ErrExhausted is returned when every usable address in the subnet is taken.
+	ErrExhausted = errors.New("mesh subnet exhausted")
+	// ErrInUse is returned when an address is already assigned to another owner.
+	ErrInUse = errors.New("address already in use")
+	// ErrOutOfRange is returned when an address is outside the subnet or reserved.
+	ErrOutOfRange = errors.New("address not allocatable from mesh subnet")
+)
+
+// Allocator hands out unique addresses from a single mesh subnet. Owners are
+// opaque strings (typically namespace/name of the object holding the address)
+// and an owner holds at most one address at a time. An address only becomes
+// available again once its owner is released.
+type Allocator struct {
+	mu       sync.Mutex
+	subnet   netip.Prefix
+	reserved map[netip.Addr]struct{}
+	byAddr   map[netip.Addr]string
+	byOwner  map[string]netip.Addr
+	// next is where the search for a free address resumes, so recently
+	// released addresses are the last to be handed out again.
+	next netip.Addr
+}
+
+// NewAllocator returns an Allocator for subnet. The network and broadcast
+// addresses are never handed out, nor is anything listed in reserved.
+func NewAllocator(subnet netip.Prefix, reserved ...netip.Addr) *Allocator {
+	subnet = subnet.Masked()
+	a := &Allocator{
+		subnet:   subnet,
+		reserved: map[netip.Addr]struct{}{},
+		byAddr:   map[netip.Addr]string{},
+		byOwner:  map[string]netip.Addr{},
+	}
+	for _, ip := range reserved {
+		a.reserved[ip] = struct{}{}
+	}
+	a.next = a.first()
+	return a
+}
+
+// Subnet returns the subnet addresses are allocated from.
+func (a *Allocator) Subnet() netip.Prefix {
+	return a.subnet
+}
+
+// Lookup returns the address currently held by owner.
+func (a *Allocator) Lookup(owner string) (netip.Addr, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ip, ok := a.byOwner[owner]
+	return ip, ok
+}
+
+// Reserve records that owner holds ip. It is used to restore allocations that
+// were persisted before, or to honour an explicitly requested address.
+// Reserving the address the owner already holds is a no-op; reserving a
+// different one releases the old address.
+func (a *Allocator) Reserve(owner string, ip netip.Addr) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.usable(ip) {
+		return fmt.Errorf("%s: %w", ip, ErrOutOfRange)
+	}
+	if holder, ok := a.byAddr[ip]; ok {
+		if holder == owner {
+			return nil
+		}
+		return fmt.Errorf("%s held by %s: %w", ip, holder, ErrInUse)
+	}
+	a.release(owner)
+	a.byAddr[ip] = owner
+	a.byOwner[owner] = ip
+	return nil
+}
+
+// Allocate returns the address held by owner, assigning a free one first if
+// owner does not hold any.
+func (a *Allocator) Allocate(owner string) (netip.Addr, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ip, ok := a.byOwner[owner]; ok {
+		return ip, nil
+	}
+
+	ip := a.next
+	for {
+		if _, taken := a.byAddr[ip]; !taken && a.usable(ip) {
+			a.byAddr[ip] = owner
+			a.byOwner[owner] = ip
+			a.next = a.advance(ip)
+			return ip, nil
+		}
+		ip = a.advance(ip)
+		if ip == a.next {
+			return netip.Addr{}, ErrExhausted
+		}
+	}
+}
+
+// Release frees the address held by owner, if any.
+func (a *Allocator) Release(owner string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.release(owner)
+}
+
+func (a *Allocator) release(owner string) {
+	if ip, ok := a.byOwner[owner]; ok {
+		delete(a.byAddr, ip)
+		delete(a.byOwner, owner)
+	}
+}
+
+// usable reports whether ip may ever be handed out.
+func (a *Allocator) usable(ip netip.Addr) bool {
+	if !a.subnet.Contains(ip) || ip == a.subnet.Addr() || ip == a.last() {
+		return false
+	}
+	_, reserved := a.reserved[ip]
+	return !reserved
+}
+
+// advance returns the address after ip, wrapping around inside the subnet.
+func (a *Allocator) advance(ip netip.Addr) netip.Addr {
+	ip = ip.Next()
+	if !ip.IsValid() || !a.subnet.Contains(ip) || ip == a.last() {
+		return a.first()
+	}
+	return ip
+}
+
+func (a *Allocator) first() netip.Addr {
+	return a.subnet.Addr().Next()
+}
+
+// last returns the broadcast address of the subnet.
+func (a *Allocator) last() netip.Addr {
+	b := a.subnet.Addr().AsSlice()
+	bits := a.subnet.Bits()
+	for i := range b {
+		hostBits := len(b)*8 - bits - (len(b)-1-i)*8
+		switch {
+		case hostBits >= 8:
+			b[i] = 0xff
+		case hostBits > 0:
+			b[i] |= byte(1<<hostBits) - 1
+		}
+	}
+	ip, _ := netip.AddrFromSlice(b)
+	return ip
+}
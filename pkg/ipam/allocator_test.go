@@ -0,0 +1,80 @@
+package ipam
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestAllocateUnique(t *testing.T) {
+	a := NewAllocator(netip.MustParsePrefix("100.255.224.0/29"), netip.MustParseAddr("100.255.224.4"))
+
+	seen := map[netip.Addr]string{}
+	for _, owner := range []string{"a", "b", "c", "d", "e"} {
+		ip, err := a.Allocate(owner)
+		if err != nil {
+			t.Fatalf("allocate %s: %v", owner, err)
+		}
+		if prev, ok := seen[ip]; ok {
+			t.Fatalf("%s handed to both %s and %s", ip, prev, owner)
+		}
+		if ip == netip.MustParseAddr("100.255.224.4") {
+			t.Fatalf("reserved address handed out to %s", owner)
+		}
+		seen[ip] = owner
+	}
+
+	if _, err := a.Allocate("f"); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("expected ErrExhausted, got %v", err)
+	}
+
+	again, err := a.Allocate("a")
+	if err != nil || seen[again] != "a" {
+		t.Fatalf("expected owner a to keep its address, got %s (%v)", again, err)
+	}
+}
+
+func TestReleaseAllowsReuse(t *testing.T) {
+	a := NewAllocator(netip.MustParsePrefix("10.0.0.0/30"))
+
+	ip, err := a.Allocate("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Allocate("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Allocate("c"); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("expected /30 to hold two addresses, got %v", err)
+	}
+
+	a.Release("a")
+	reused, err := a.Allocate("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused != ip {
+		t.Fatalf("expected %s to be reused, got %s", ip, reused)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	a := NewAllocator(netip.MustParsePrefix("100.255.224.0/24"))
+	ip := netip.MustParseAddr("100.255.224.10")
+
+	if err := a.Reserve("a", ip); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reserve("b", ip); !errors.Is(err, ErrInUse) {
+		t.Fatalf("expected ErrInUse, got %v", err)
+	}
+	if err := a.Reserve("b", netip.MustParseAddr("100.255.224.255")); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("expected broadcast address to be rejected, got %v", err)
+	}
+	if err := a.Reserve("b", netip.MustParseAddr("10.0.0.1")); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("expected foreign address to be rejected, got %v", err)
+	}
+	if got, _ := a.Allocate("a"); got != ip {
+		t.Fatalf("expected reserved %s, got %s", ip, got)
+	}
+}
@@ -0,0 +1,90 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// FileStore keeps the private key in a file readable only by its owner,
+// typically on a hostPath volume so it outlives the pod.
+type FileStore struct {
+	Path string
+}
+
+var _ Store = &FileStore{}
+
+// Load implements Store.
+func (f *FileStore) Load(_ context.Context) (wgtypes.Key, error) {
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return wgtypes.Key{}, ErrNotFound
+	}
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+	key, err := wgtypes.ParseKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("%s: %w", f.Path, err)
+	}
+	return key, nil
+}
+
+// Save implements Store. The key is written to a temporary file which is then
+// renamed over Path, so a crash never leaves a truncated key behind.
+func (f *FileStore) Save(_ context.Context, key wgtypes.Key) error {
+	dir := filepath.Dir(f.Path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(f.Path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.WriteString(key.String() + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// Delete implements Store.
+func (f *FileStore) Delete(_ context.Context) error {
+	err := os.Remove(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// SavedAt implements Store using the modification time of the key file.
+func (f *FileStore) SavedAt(_ context.Context) (time.Time, error) {
+	info, err := os.Stat(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
@@ -0,0 +1,47 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	s := &FileStore{Path: filepath.Join(t.TempDir(), "keys", "agent.key")}
+
+	if _, err := s.Load(ctx); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	key, created, err := LoadOrCreate(ctx, s)
+	if err != nil || !created {
+		t.Fatalf("expected a new key to be created, got created=%v err=%v", created, err)
+	}
+
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("expected key file mode 0600, got %o", perm)
+	}
+
+	again, created, err := LoadOrCreate(ctx, s)
+	if err != nil || created {
+		t.Fatalf("expected stored key to be reused, got created=%v err=%v", created, err)
+	}
+	if again != key {
+		t.Fatal("reloaded key differs from the stored one")
+	}
+
+	rotated, err := Rotate(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ := s.Load(ctx); rotated == key || loaded != rotated {
+		t.Fatal("expected rotation to replace the stored key")
+	}
+}
@@ -0,0 +1,63 @@
+package keystore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ErrNotFound is returned by Store.Load when no key has been saved yet.
+var ErrNotFound = errors.New("no private key stored")
+
+// Store persists a WireGuard private key across process and interface restarts.
+type Store interface {
+	// Load returns the stored key, or ErrNotFound if there is none.
+	Load(ctx context.Context) (wgtypes.Key, error)
+	// Save stores key, replacing any previously stored key.
+	Save(ctx context.Context, key wgtypes.Key) error
+	// Delete removes the stored key. Deleting a missing key is not an error.
+	Delete(ctx context.Context) error
+	// SavedAt returns when the stored key was saved, or ErrNotFound.
+	SavedAt(ctx context.Context) (time.Time, error)
+}
+
+// LoadOrCreate returns the key held by s. If s holds no key yet a new one is
+// generated and saved; created reports whether that happened.
+func LoadOrCreate(ctx context.Context, s Store) (key wgtypes.Key, created bool, err error) {
+	key, err = s.Load(ctx)
+	if err == nil {
+		return key, false, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return wgtypes.Key{}, false, err
+	}
+	key, err = Rotate(ctx, s)
+	if err != nil {
+		return wgtypes.Key{}, false, err
+	}
+	return key, true, nil
+}
+
+// Rotate generates a new key and saves it in s, replacing the current one.
+func Rotate(ctx context.Context, s Store) (wgtypes.Key, error) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("generating private key: %w", err)
+	}
+	if err := s.Save(ctx, key); err != nil {
+		return wgtypes.Key{}, fmt.Errorf("saving private key: %w", err)
+	}
+	return key, nil
+}
+
+// Fingerprint returns a short, non-secret identifier of a public key suitable
+// for audit logs and resource status.
+func Fingerprint(publicKey wgtypes.Key) string {
+	sum := sha256.Sum256(publicKey[:])
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
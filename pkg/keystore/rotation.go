@@ -0,0 +1,96 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Rotator replaces a private key on a schedule. Rotation happens in two
+// steps so counterparts never see an unknown key: once the current key is
+// Period old a next key is generated and staged, to be published alongside
+// the current one, and after a further Overlap the staged key replaces the
+// current key.
+type Rotator struct {
+	// Current holds the key in use. It must already contain a key.
+	Current Store
+	// Next holds the staged key while a rotation is in progress.
+	Next Store
+	// Period is the lifetime of a key. Zero disables rotation.
+	Period time.Duration
+	// Overlap is how long a staged key is published before it is used.
+	Overlap time.Duration
+}
+
+// RotationState is the outcome of Rotator.Step.
+type RotationState struct {
+	// Current is the key that should be configured on the device.
+	Current wgtypes.Key
+	// Next is the staged key, nil when no rotation is in progress.
+	Next *wgtypes.Key
+	// RotatedAt is when Current was put into use.
+	RotatedAt time.Time
+	// Rotated reports whether Current was replaced by this step.
+	Rotated bool
+}
+
+// Step advances the rotation to where it should be at now.
+func (r *Rotator) Step(ctx context.Context, now time.Time) (RotationState, error) {
+	current, err := r.Current.Load(ctx)
+	if err != nil {
+		return RotationState{}, err
+	}
+	rotatedAt, err := r.Current.SavedAt(ctx)
+	if err != nil {
+		return RotationState{}, err
+	}
+	state := RotationState{Current: current, RotatedAt: rotatedAt}
+
+	next, err := r.Next.Load(ctx)
+	switch {
+	case errors.Is(err, ErrNotFound):
+	case err != nil:
+		return RotationState{}, err
+	default:
+		state.Next = &next
+	}
+
+	if r.Period <= 0 {
+		return state, nil
+	}
+	due := rotatedAt.Add(r.Period)
+	if now.Before(due) {
+		return state, nil
+	}
+
+	if state.Next == nil {
+		next, err := Rotate(ctx, r.Next)
+		if err != nil {
+			return RotationState{}, err
+		}
+		state.Next = &next
+		return state, nil
+	}
+
+	stagedAt, err := r.Next.SavedAt(ctx)
+	if err != nil {
+		return RotationState{}, err
+	}
+	if now.Before(stagedAt.Add(r.Overlap)) {
+		return state, nil
+	}
+
+	if err := r.Current.Save(ctx, *state.Next); err != nil {
+		return RotationState{}, err
+	}
+	if err := r.Next.Delete(ctx); err != nil {
+		return RotationState{}, err
+	}
+	return RotationState{
+		Current:   *state.Next,
+		RotatedAt: now,
+		Rotated:   true,
+	}, nil
+}
@@ -0,0 +1,80 @@
+package keystore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatorStep(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := &Rotator{
+		Current: &FileStore{Path: filepath.Join(dir, "agent.key")},
+		Next:    &FileStore{Path: filepath.Join(dir, "agent.key.next")},
+		Period:  time.Hour,
+		Overlap: 2 * time.Hour,
+	}
+	initial, _, err := LoadOrCreate(ctx, r.Current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+
+	state, err := r.Step(ctx, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Current != initial || state.Next != nil || state.Rotated {
+		t.Fatalf("expected no rotation before the period elapsed, got %+v", state)
+	}
+
+	state, err = r.Step(ctx, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Current != initial || state.Next == nil || state.Rotated {
+		t.Fatalf("expected a staged next key once the period elapsed, got %+v", state)
+	}
+	staged := *state.Next
+
+	state, err = r.Step(ctx, start.Add(90*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Current != initial || state.Next == nil || *state.Next != staged {
+		t.Fatalf("expected the staged key to be kept during the overlap, got %+v", state)
+	}
+
+	state, err = r.Step(ctx, start.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Current != staged || state.Next != nil || !state.Rotated {
+		t.Fatalf("expected the staged key to become current, got %+v", state)
+	}
+	if loaded, _ := r.Current.Load(ctx); loaded != staged {
+		t.Fatal("expected the rotated key to be persisted")
+	}
+}
+
+func TestRotatorDisabled(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := &Rotator{
+		Current: &FileStore{Path: filepath.Join(dir, "agent.key")},
+		Next:    &FileStore{Path: filepath.Join(dir, "agent.key.next")},
+	}
+	if _, _, err := LoadOrCreate(ctx, r.Current); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := r.Step(ctx, time.Now().Add(24*365*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Next != nil || state.Rotated {
+		t.Fatalf("expected no rotation with a zero period, got %+v", state)
+	}
+}
@@ -0,0 +1,141 @@
+package keystore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// SecretKeyField is the default data field of the Secret holding the private key.
+	SecretKeyField = "privateKey"
+	// savedAtAnnotationPrefix prefixes the annotation recording when a field was saved.
+	savedAtAnnotationPrefix = "aks.azure.com/saved-at."
+)
+
+// SecretStore keeps the private key in a field of a Kubernetes Secret.
+// Several stores may share one Secret by using different fields.
+type SecretStore struct {
+	Client    client.Client
+	Namespace string
+	Name      string
+	// Field is the data field holding the key, SecretKeyField if empty.
+	Field string
+}
+
+var _ Store = &SecretStore{}
+
+// Load implements Store.
+func (s *SecretStore) Load(ctx context.Context) (wgtypes.Key, error) {
+	secret, err := s.get(ctx)
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+
+	data, ok := secret.Data[s.field()]
+	if !ok {
+		return wgtypes.Key{}, ErrNotFound
+	}
+	key, err := wgtypes.ParseKey(string(data))
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("secret %s/%s: %w", s.Namespace, s.Name, err)
+	}
+	return key, nil
+}
+
+// Save implements Store.
+func (s *SecretStore) Save(ctx context.Context, key wgtypes.Key) error {
+	secret := &corev1.Secret{}
+	err := s.Client.Get(ctx, client.ObjectKey{Namespace: s.Namespace, Name: s.Name}, secret)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	savedAt := time.Now().UTC().Format(time.RFC3339)
+	if apierrors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.Name,
+				Namespace: s.Namespace,
+				Annotations: map[string]string{
+					savedAtAnnotationPrefix + s.field(): savedAt,
+				},
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: map[string][]byte{
+				s.field(): []byte(key.String()),
+			},
+		}
+		return s.Client.Create(ctx, secret)
+	}
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Data[s.field()] = []byte(key.String())
+	secret.Annotations[savedAtAnnotationPrefix+s.field()] = savedAt
+	return s.Client.Update(ctx, secret)
+}
+
+// Delete implements Store. Only the field is removed, the Secret is kept.
+func (s *SecretStore) Delete(ctx context.Context) error {
+	secret, err := s.get(ctx)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := secret.Data[s.field()]; !ok {
+		return nil
+	}
+	delete(secret.Data, s.field())
+	delete(secret.Annotations, savedAtAnnotationPrefix+s.field())
+	return s.Client.Update(ctx, secret)
+}
+
+// SavedAt implements Store. Keys saved before the timestamp annotation existed
+// report the creation time of the Secret.
+func (s *SecretStore) SavedAt(ctx context.Context) (time.Time, error) {
+	secret, err := s.get(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if _, ok := secret.Data[s.field()]; !ok {
+		return time.Time{}, ErrNotFound
+	}
+	if v, ok := secret.Annotations[savedAtAnnotationPrefix+s.field()]; ok {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, nil
+		}
+	}
+	return secret.CreationTimestamp.Time, nil
+}
+
+func (s *SecretStore) get(ctx context.Context) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	err := s.Client.Get(ctx, client.ObjectKey{Namespace: s.Namespace, Name: s.Name}, secret)
+	if apierrors.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func (s *SecretStore) field() string {
+	if s.Field == "" {
+		return SecretKeyField
+	}
+	return s.Field
+}
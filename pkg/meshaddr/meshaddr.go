@@ -0,0 +1,71 @@
+// Package meshaddr parses the addresses published in Peer and Gateway
+// objects into the networks the agent and gateway configure.
+package meshaddr
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// ParseIPOrCIDR parses a network in CIDR notation or a single address as a
+// host network.
+func ParseIPOrCIDR(s string) (net.IPNet, error) {
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		return *ipNet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return net.IPNet{}, fmt.Errorf("invalid allowed IP %q", s)
+	}
+	return HostNet(ip), nil
+}
+
+// ParsePrefix parses an address block in CIDR notation, or a single address
+// as a host prefix.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// HostNet returns the network holding only ip, a /32 or a /128.
+func HostNet(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// Addrs returns the mesh addresses recorded in a Peer or Gateway status,
+// each with the mask of the mesh network it was allocated from. Objects
+// assigned an address before dual-stack support only record meshIP and
+// meshSubnet.
+func Addrs(meshIP, meshSubnet string, meshIPs, meshSubnets []string) ([]net.IPNet, error) {
+	if len(meshIPs) == 0 && meshIP != "" {
+		meshIPs, meshSubnets = []string{meshIP}, []string{meshSubnet}
+	}
+	addrs := make([]net.IPNet, 0, len(meshIPs))
+	for i, s := range meshIPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid mesh IP %q", s)
+		}
+		addr := HostNet(ip)
+		if i < len(meshSubnets) && meshSubnets[i] != "" {
+			_, subnet, err := net.ParseCIDR(meshSubnets[i])
+			if err != nil || !subnet.Contains(ip) {
+				return nil, fmt.Errorf("invalid mesh IP %q in subnet %q", s, meshSubnets[i])
+			}
+			addr.Mask = subnet.Mask
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
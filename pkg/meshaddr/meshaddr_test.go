@@ -0,0 +1,148 @@
+package meshaddr
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParseIPOrCIDR(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "10.241.0.0/28", want: "10.241.0.0/28"},
+		{in: "10.241.0.5/28", want: "10.241.0.0/28"},
+		{in: "10.241.0.5", want: "10.241.0.5/32"},
+		{in: "::ffff:10.241.0.5", want: "10.241.0.5/32"},
+		{in: "fd00:10:244::/56", want: "fd00:10:244::/56"},
+		{in: "fd00:10:244::5", want: "fd00:10:244::5/128"},
+		{in: "10.241.0.0/33", wantErr: true},
+		{in: "node-1", wantErr: true},
+		{in: "", wantErr: true},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := ParseIPOrCIDR(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, got.String())
+			}
+		})
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "10.241.0.0/28", want: "10.241.0.0/28"},
+		{in: "10.241.0.5/28", want: "10.241.0.0/28"},
+		{in: "10.241.0.5", want: "10.241.0.5/32"},
+		{in: "::ffff:10.241.0.5", want: "10.241.0.5/32"},
+		{in: "fd00:10:244::5", want: "fd00:10:244::5/128"},
+		{in: "10.241.0.0/33", wantErr: true},
+		{in: "node-1", wantErr: true},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := ParsePrefix(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestHostNet(t *testing.T) {
+	if got := HostNet(net.ParseIP("100.255.224.1")); got.String() != "100.255.224.1/32" || len(got.IP) != net.IPv4len {
+		t.Fatalf("expected a 4 byte /32, got %s (%d bytes)", got.String(), len(got.IP))
+	}
+	if got := HostNet(net.ParseIP("fdaa:5e55:100:ffff::1")); got.String() != "fdaa:5e55:100:ffff::1/128" {
+		t.Fatalf("expected a /128, got %s", got.String())
+	}
+}
+
+func TestAddrs(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		meshIP      string
+		meshSubnet  string
+		meshIPs     []string
+		meshSubnets []string
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name: "nothing assigned",
+		},
+		{
+			name:       "single stack status",
+			meshIP:     "100.255.224.1",
+			meshSubnet: "100.255.224.0/19",
+			want:       []string{"100.255.224.1/19"},
+		},
+		{
+			name:        "dual stack status",
+			meshIP:      "100.255.224.1",
+			meshSubnet:  "100.255.224.0/19",
+			meshIPs:     []string{"100.255.224.1", "fdaa:5e55:100:ffff::1"},
+			meshSubnets: []string{"100.255.224.0/19", "fdaa:5e55:100:ffff::/112"},
+			want:        []string{"100.255.224.1/19", "fdaa:5e55:100:ffff::1/112"},
+		},
+		{
+			name:    "host addresses without subnets",
+			meshIPs: []string{"100.255.224.1", "fdaa:5e55:100:ffff::1"},
+			want:    []string{"100.255.224.1/32", "fdaa:5e55:100:ffff::1/128"},
+		},
+		{
+			name:    "invalid address",
+			meshIPs: []string{"100.255.224"},
+			wantErr: true,
+		},
+		{
+			name:        "address outside its subnet",
+			meshIPs:     []string{"100.255.0.1"},
+			meshSubnets: []string{"100.255.224.0/19"},
+			wantErr:     true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addrs, err := Addrs(tc.meshIP, tc.meshSubnet, tc.meshIPs, tc.meshSubnets)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", addrs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(addrs))
+			for _, addr := range addrs {
+				got = append(got, addr.String())
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package podaddrs
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	acnv1alpha "github.com/Azure/azure-container-networking/crd/nodenetworkconfig/api/v1alpha"
+	"github.com/t-chdossa_microsoft/aks-mesh/pkg/acn"
+)
+
+// NNCSource returns every pod-facing address block of the network containers
+// in the node's Azure CNI NodeNetworkConfig, including secondary IPs.
+type NNCSource struct {
+	Client acn.NncGetter
+}
+
+var _ Source = &NNCSource{}
+var _ Watcher = &NNCSource{}
+
+// PodAddresses implements Source. Addresses that do not parse are skipped as
+// long as any address is valid, so one bad entry does not hide the others.
+func (s *NNCSource) PodAddresses(ctx context.Context, nodeName string) ([]string, error) {
+	prefixes, err := acn.GetPodPrefixes(ctx, s.Client, nodeName)
+	if len(prefixes) == 0 {
+		if err != nil {
+			return nil, fmt.Errorf("getting pod prefixes from NodeNetworkConfig: %w", err)
+		}
+		// CNI may not have assigned a network container yet
+		return nil, fmt.Errorf("no pod addresses found in NodeNetworkConfig %s: %w", nodeName, ErrNotAssigned)
+	}
+	if err != nil {
+		log.Printf("Ignoring invalid addresses in NodeNetworkConfig %s: %v", nodeName, err)
+	}
+	addrs := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		addrs = append(addrs, prefix.String())
+	}
+	return addrs, nil
+}
+
+// Watch implements Watcher, the network containers of a node can be
+// reassigned at any time.
+func (s *NNCSource) Watch(ctx context.Context, nodeName string, changed func()) error {
+	return s.Client.WatchNnc(ctx, nodeName, func(*acnv1alpha.NodeNetworkConfig) { changed() })
+}
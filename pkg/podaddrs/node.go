@@ -0,0 +1,33 @@
+package podaddrs
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// NodeSource returns the pod CIDRs in the Node spec, which is where clusters
+// whose nodes get a pod range from the node IPAM controller, such as kind or
+// kubenet clusters, record them.
+type NodeSource struct {
+	Client client.Reader
+}
+
+var _ Source = &NodeSource{}
+
+// PodAddresses implements Source.
+func (s *NodeSource) PodAddresses(ctx context.Context, nodeName string) ([]string, error) {
+	node := &corev1.Node{}
+	if err := s.Client.Get(ctx, client.ObjectKey{Name: nodeName}, node); err != nil {
+		return nil, fmt.Errorf("getting node: %w", err)
+	}
+	if len(node.Spec.PodCIDRs) > 0 {
+		return node.Spec.PodCIDRs, nil
+	}
+	if node.Spec.PodCIDR != "" {
+		return []string{node.Spec.PodCIDR}, nil
+	}
+	return nil, ErrNotAssigned
+}
@@ -0,0 +1,53 @@
+// Package podaddrs discovers the pod addresses a node owns, which the node's
+// Peer advertises as its allowed IPs.
+package podaddrs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrNotAssigned is returned while a node has not been given any pod
+// addresses yet, for example before the CNI has set up the node.
+var ErrNotAssigned = errors.New("no pod addresses assigned to node")
+
+// Source returns the pod addresses a node owns.
+type Source interface {
+	// PodAddresses returns the addresses and networks owned by the node, as
+	// IP addresses or in CIDR notation, or ErrNotAssigned.
+	PodAddresses(ctx context.Context, nodeName string) ([]string, error)
+}
+
+// Watcher is implemented by Sources whose addresses can change while the
+// node runs.
+type Watcher interface {
+	// Watch calls changed whenever the addresses of the node may have
+	// changed, until ctx is done. It returns once the watch is established.
+	Watch(ctx context.Context, nodeName string, changed func()) error
+}
+
+// StaticSource returns the same fixed addresses for every node. It suits
+// clusters where the addresses are passed to each node's agent by other
+// means.
+type StaticSource struct {
+	Addresses []string
+}
+
+var _ Source = &StaticSource{}
+
+// PodAddresses implements Source.
+func (s *StaticSource) PodAddresses(_ context.Context, _ string) ([]string, error) {
+	if len(s.Addresses) == 0 {
+		return nil, ErrNotAssigned
+	}
+	for _, addr := range s.Addresses {
+		if net.ParseIP(addr) == nil {
+			if _, _, err := net.ParseCIDR(addr); err != nil {
+				return nil, fmt.Errorf("invalid pod address %q", addr)
+			}
+		}
+	}
+	return s.Addresses, nil
+}
@@ -0,0 +1,60 @@
+package podaddrs
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestStaticSource(t *testing.T) {
+	ctx := context.Background()
+
+	s := &StaticSource{Addresses: []string{"10.244.1.0/24", "fd00:10:244:1::/64", "10.0.0.5"}}
+	addrs, err := s.PodAddresses(ctx, "node")
+	if err != nil || !slices.Equal(addrs, s.Addresses) {
+		t.Fatalf("expected the static addresses, got %v (%v)", addrs, err)
+	}
+
+	if _, err := (&StaticSource{}).PodAddresses(ctx, "node"); !errors.Is(err, ErrNotAssigned) {
+		t.Fatalf("expected ErrNotAssigned, got %v", err)
+	}
+	if _, err := (&StaticSource{Addresses: []string{"10.244.1.0/33"}}).PodAddresses(ctx, "node"); err == nil {
+		t.Fatal("expected an invalid address to be rejected")
+	}
+}
+
+func TestNodeSource(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().WithObjects(
+		&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "dual"},
+			Spec:       corev1.NodeSpec{PodCIDR: "10.244.1.0/24", PodCIDRs: []string{"10.244.1.0/24", "fd00:10:244:1::/64"}},
+		},
+		&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "legacy"},
+			Spec:       corev1.NodeSpec{PodCIDR: "10.244.2.0/24"},
+		},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "pending"}},
+	).Build()
+	s := &NodeSource{Client: c}
+
+	addrs, err := s.PodAddresses(ctx, "dual")
+	if err != nil || !slices.Equal(addrs, []string{"10.244.1.0/24", "fd00:10:244:1::/64"}) {
+		t.Fatalf("expected both pod CIDRs, got %v (%v)", addrs, err)
+	}
+	addrs, err = s.PodAddresses(ctx, "legacy")
+	if err != nil || !slices.Equal(addrs, []string{"10.244.2.0/24"}) {
+		t.Fatalf("expected the legacy pod CIDR, got %v (%v)", addrs, err)
+	}
+	if _, err := s.PodAddresses(ctx, "pending"); !errors.Is(err, ErrNotAssigned) {
+		t.Fatalf("expected ErrNotAssigned, got %v", err)
+	}
+	if _, err := s.PodAddresses(ctx, "missing"); err == nil || errors.Is(err, ErrNotAssigned) {
+		t.Fatalf("expected a lookup error, got %v", err)
+	}
+}
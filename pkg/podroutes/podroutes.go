@@ -0,0 +1,70 @@
+// Package podroutes programs the routes that send pod traffic into a
+// WireGuard interface.
+package podroutes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Protocol marks the pod routes the agent and the gateway program, so routes
+// they no longer want can be told apart from all others.
+const Protocol netlink.RouteProtocol = 0x4d
+
+// Ensure routes every network in dsts to link and removes the pod routes on
+// link to networks not in dsts. A network that cannot be routed, such as an
+// IPv6 network on a host with IPv6 disabled, does not keep the others from
+// being routed.
+func Ensure(link netlink.Link, dsts []net.IPNet) error {
+	existing, err := List(link)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	desired := make(map[string]struct{}, len(dsts))
+	for i := range dsts {
+		desired[dsts[i].String()] = struct{}{}
+		err := netlink.RouteReplace(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &dsts[i],
+			Scope:     netlink.SCOPE_LINK,
+			Protocol:  Protocol,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("route to %s: %w", dsts[i].String(), err))
+		}
+	}
+	for _, route := range existing {
+		if _, ok := desired[route.Dst.String()]; ok {
+			continue
+		}
+		log.Printf("removing stale pod route %s", route.Dst)
+		if err := netlink.RouteDel(&route); err != nil {
+			errs = append(errs, fmt.Errorf("removing route to %s: %w", route.Dst, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// List returns the pod routes on link.
+func List(link netlink.Link) ([]netlink.Route, error) {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Protocol:  Protocol,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return nil, fmt.Errorf("listing pod routes: %w", err)
+	}
+	podRoutes := routes[:0]
+	for _, route := range routes {
+		if route.Dst != nil {
+			podRoutes = append(podRoutes, route)
+		}
+	}
+	return podRoutes, nil
+}